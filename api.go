@@ -0,0 +1,494 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const API_DEFAULT_PER_PAGE = 30
+const API_MAX_PER_PAGE = 100
+
+// apiError writes the error body shared by all /api/v1 endpoints
+func apiError(c *gin.Context, status int, code, message string) {
+	c.JSON(status, gin.H{"error": gin.H{"code": code, "message": message}})
+	c.Abort()
+}
+
+// ApiLines are the lines of a single time window
+type ApiLines struct {
+	Code      int `json:"code"`
+	Tests     int `json:"tests"`
+	Docs      int `json:"docs"`
+	Resources int `json:"resources"`
+	Generated int `json:"generated"`
+	// code, tests, docs and resources like the contributors order on the page, generated lines excluded
+	Total int `json:"total"`
+}
+
+func newApiLines(window string, code, tests, docs, resources, generated *LinesStat) ApiLines {
+	l := ApiLines{
+		Code:      code.Window(window),
+		Tests:     tests.Window(window),
+		Docs:      docs.Window(window),
+		Resources: resources.Window(window),
+		Generated: generated.Window(window),
+	}
+	l.Total = l.Code + l.Tests + l.Docs + l.Resources
+	return l
+}
+
+type ApiRepo struct {
+	Host         string   `json:"host"`
+	Owner        string   `json:"owner"`
+	Name         string   `json:"name"`
+	Ref          string   `json:"ref,omitempty"`
+	AsOf         string   `json:"asof,omitempty"`
+	Hash         string   `json:"hash"`
+	Commit       string   `json:"commit"`
+	Window       string   `json:"window"`
+	Lines        ApiLines `json:"lines"`
+	Contributors int      `json:"contributors"`
+}
+
+type ApiContributor struct {
+	Username string   `json:"username,omitempty"`
+	Email    string   `json:"email"`
+	Emails   []string `json:"emails,omitempty"`
+	Lines    ApiLines `json:"lines"`
+}
+
+type ApiExtension struct {
+	Ext   string `json:"ext"`
+	Lines int    `json:"lines"`
+}
+
+type ApiOwner struct {
+	Username string  `json:"username,omitempty"`
+	Email    string  `json:"email"`
+	Lines    int     `json:"lines"`
+	Share    float64 `json:"share"` // of the node lines
+}
+
+type ApiTreeNode struct {
+	Name     string         `json:"name"`
+	Path     string         `json:"path"`
+	File     bool           `json:"file,omitempty"`
+	Lines    int            `json:"lines"`
+	Owners   []ApiOwner     `json:"owners"`
+	Children []*ApiTreeNode `json:"children,omitempty"`
+}
+
+type ApiBusFactor struct {
+	Path         string     `json:"path"`
+	CodeLines    int        `json:"code_lines"`
+	BusFactor    int        `json:"bus_factor"`
+	Owners       []ApiOwner `json:"owners"` // share of the code lines
+	Inactive     bool       `json:"inactive,omitempty"`
+	InactiveDays int        `json:"inactive_days,omitempty"`
+}
+
+func newApiBusFactor(bf BusFactor, users map[string]*UserStat) ApiBusFactor {
+	res := ApiBusFactor{Path: bf.Path, CodeLines: bf.CodeLines, BusFactor: len(bf.Owners), Owners: []ApiOwner{}, Inactive: bf.Inactive, InactiveDays: bf.InactiveDays}
+	for _, o := range bf.Owners {
+		owner := ApiOwner{Email: o.Email, Lines: o.Lines, Share: float64(o.Lines) / float64(bf.CodeLines)}
+		if us, exists := users[o.Email]; exists {
+			owner.Username = us.Username
+		}
+		res.Owners = append(res.Owners, owner)
+	}
+	return res
+}
+
+type ByApiOwnerLines []ApiOwner
+
+func (a ByApiOwnerLines) Len() int      { return len(a) }
+func (a ByApiOwnerLines) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByApiOwnerLines) Less(i, j int) bool {
+	return a[i].Lines > a[j].Lines
+}
+
+// newApiTreeNode renders the node and its children down to depth levels
+func newApiTreeNode(d *DirStat, nodePath, window string, depth int, users map[string]*UserStat) *ApiTreeNode {
+	node := ApiTreeNode{Name: d.Name, Path: nodePath, File: d.File, Lines: d.Lines.Window(window), Owners: []ApiOwner{}}
+	for _, u := range d.Users {
+		lines := u.Lines.Window(window)
+		if lines == 0 {
+			continue
+		}
+		owner := ApiOwner{Email: u.Email, Lines: lines, Share: float64(lines) / float64(node.Lines)}
+		if us, exists := users[u.Email]; exists {
+			owner.Username = us.Username
+		}
+		node.Owners = append(node.Owners, owner)
+	}
+	sort.Stable(ByApiOwnerLines(node.Owners))
+
+	if depth > 0 {
+		for _, child := range d.Children {
+			if child.Lines.Window(window) == 0 {
+				continue
+			}
+			node.Children = append(node.Children, newApiTreeNode(child, path.Join(nodePath, child.Name), window, depth-1, users))
+		}
+	}
+	return &node
+}
+
+type ByApiLines struct {
+	users []ApiContributor
+	lines func(l ApiLines) int
+}
+
+func (a ByApiLines) Len() int      { return len(a.users) }
+func (a ByApiLines) Swap(i, j int) { a.users[i], a.users[j] = a.users[j], a.users[i] }
+func (a ByApiLines) Less(i, j int) bool {
+	return a.lines(a.users[i].Lines) > a.lines(a.users[j].Lines)
+}
+
+type ByApiExtLines []ApiExtension
+
+func (a ByApiExtLines) Len() int      { return len(a) }
+func (a ByApiExtLines) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByApiExtLines) Less(i, j int) bool {
+	if a[i].Lines != a[j].Lines {
+		return a[i].Lines > a[j].Lines
+	}
+	return a[i].Ext < a[j].Ext
+}
+
+var apiSortKeys = map[string]func(l ApiLines) int{
+	"code":  func(l ApiLines) int { return l.Code },
+	"tests": func(l ApiLines) int { return l.Tests },
+	"docs":  func(l ApiLines) int { return l.Docs },
+	"total": func(l ApiLines) int { return l.Total },
+}
+
+func apiRepoConfig(c *gin.Context) RepoConfig {
+	return RepoConfig{
+		URL:  "https://" + c.Param("host") + "/" + c.Param("repo"),
+		Ref:  c.Query("ref"),
+		AsOf: c.Query("asof"),
+	}
+}
+
+func apiWindow(c *gin.Context, def string) (string, bool) {
+	window, ok := ParseWindow(c.DefaultQuery("window", def))
+	if !ok {
+		apiError(c, http.StatusBadRequest, "bad_window", "window must be one of LastMonth, Last3Month, Last6Month, LastYear, Total or a 2006-01..2006-12 month range")
+	}
+	return window, ok
+}
+
+// apiRepoStat returns the analyzed repo or writes the response explaining why there is none
+func apiRepoStat(c *gin.Context) (*Repo, bool) {
+	rc := apiRepoConfig(c)
+	if _, _, _, err := rc.ParseURL(); err != nil {
+		apiError(c, http.StatusBadRequest, "bad_repo", err.Error())
+		return nil, false
+	}
+
+	repo := rc.Repo()
+	if repo.Stat = repo.getCachedStat(); repo.Stat != nil {
+		return repo, true
+	}
+
+	p, err := workerProgress(repo.Hash)
+	switch {
+	case err != nil:
+		apiError(c, http.StatusServiceUnavailable, "worker_unavailable", err.Error())
+	case p == nil:
+		apiError(c, http.StatusNotFound, "not_analyzed", "Repo is not analyzed, POST to .../analyze first")
+	case p.State == JobFailed:
+		apiError(c, http.StatusUnprocessableEntity, "analysis_failed", p.Error)
+	default:
+		c.JSON(http.StatusAccepted, gin.H{"status": "processing", "progress": p})
+		c.Abort()
+	}
+	return nil, false
+}
+
+func apiRepoHandler(c *gin.Context) {
+	window, ok := apiWindow(c, "Total")
+	if !ok {
+		return
+	}
+	repo, ok := apiRepoStat(c)
+	if !ok {
+		return
+	}
+
+	rs := repo.Stat
+	c.JSON(http.StatusOK, ApiRepo{
+		Host:         repo.Host,
+		Owner:        repo.Owner,
+		Name:         repo.Name,
+		Ref:          repo.Ref,
+		AsOf:         repo.AsOf,
+		Hash:         repo.Hash,
+		Commit:       rs.Commit,
+		Window:       window,
+		Lines:        newApiLines(window, &rs.CodeLines, &rs.TestLines, &rs.DocLines, &rs.Resources, &rs.Generated),
+		Contributors: len(rs.Users),
+	})
+}
+
+func apiContributorsHandler(c *gin.Context) {
+	window, ok := apiWindow(c, "Total")
+	if !ok {
+		return
+	}
+	sortKey, ok := apiSortKeys[c.DefaultQuery("sort", "total")]
+	if !ok {
+		apiError(c, http.StatusBadRequest, "bad_sort", "sort must be one of code, docs, tests, total")
+		return
+	}
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		apiError(c, http.StatusBadRequest, "bad_page", "page must be a positive number")
+		return
+	}
+	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(API_DEFAULT_PER_PAGE)))
+	if err != nil || perPage < 1 || perPage > API_MAX_PER_PAGE {
+		apiError(c, http.StatusBadRequest, "bad_per_page", "per_page must be between 1 and "+strconv.Itoa(API_MAX_PER_PAGE))
+		return
+	}
+	repo, ok := apiRepoStat(c)
+	if !ok {
+		return
+	}
+
+	users := []ApiContributor{}
+	for _, u := range repo.Stat.Users {
+		lines := newApiLines(window, &u.CodeLines, &u.TestLines, &u.DocLines, &u.Resources, &u.Generated)
+		// contributors without lines in the window are left out
+		if lines.Total == 0 && lines.Generated == 0 {
+			continue
+		}
+		users = append(users, ApiContributor{Username: u.Username, Email: u.Email, Emails: u.Emails, Lines: lines})
+	}
+	sort.Stable(ByApiLines{users: users, lines: sortKey})
+
+	from := (page - 1) * perPage
+	if from > len(users) {
+		from = len(users)
+	}
+	to := from + perPage
+	if to > len(users) {
+		to = len(users)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"window":       window,
+		"page":         page,
+		"per_page":     perPage,
+		"total":        len(users),
+		"contributors": users[from:to],
+	})
+}
+
+func apiExtensionsHandler(c *gin.Context) {
+	window, ok := apiWindow(c, "Total")
+	if !ok {
+		return
+	}
+	repo, ok := apiRepoStat(c)
+	if !ok {
+		return
+	}
+
+	lines := make(map[string]int)
+	for _, u := range repo.Stat.Users {
+		for ext, l := range u.LinesPerExt {
+			lines[ext] += l.Window(window)
+		}
+	}
+	exts := []ApiExtension{}
+	for ext, n := range lines {
+		if n > 0 {
+			exts = append(exts, ApiExtension{Ext: ext, Lines: n})
+		}
+	}
+	sort.Sort(ByApiExtLines(exts))
+	c.JSON(http.StatusOK, gin.H{"window": window, "extensions": exts})
+}
+
+func apiTreeHandler(c *gin.Context) {
+	window, ok := apiWindow(c, "Total")
+	if !ok {
+		return
+	}
+	depth, err := strconv.Atoi(c.DefaultQuery("depth", "1"))
+	if err != nil || depth < 0 {
+		apiError(c, http.StatusBadRequest, "bad_depth", "depth must be a non-negative number")
+		return
+	}
+	repo, ok := apiRepoStat(c)
+	if !ok {
+		return
+	}
+	if repo.Stat.Tree == nil {
+		apiError(c, http.StatusNotFound, "no_tree", "Repo was analyzed before directory stats were kept, POST to .../analyze?refresh=1")
+		return
+	}
+
+	nodePath := strings.Trim(c.Query("path"), "/")
+	d := repo.Stat.Tree.Find(nodePath)
+	if d == nil {
+		apiError(c, http.StatusNotFound, "no_path", "No files under "+nodePath)
+		return
+	}
+
+	users := make(map[string]*UserStat)
+	for _, u := range repo.Stat.Users {
+		users[u.Email] = u
+	}
+	node := newApiTreeNode(d, nodePath, window, depth, users)
+	c.JSON(http.StatusOK, gin.H{"window": window, "tree": node})
+}
+
+func apiShare(c *gin.Context, name, def string) (float64, bool) {
+	share, err := strconv.ParseFloat(c.DefaultQuery(name, def), 64)
+	if err != nil || share <= 0 || share > 1 {
+		apiError(c, http.StatusBadRequest, "bad_"+name, name+" must be a fraction between 0 and 1")
+		return 0, false
+	}
+	return share, true
+}
+
+func apiCodeOwnersHandler(c *gin.Context) {
+	// ownership is judged by recent lines
+	window, ok := apiWindow(c, "LastYear")
+	if !ok {
+		return
+	}
+	minShare, ok := apiShare(c, "min_share", "0.2")
+	if !ok {
+		return
+	}
+	staleShare, ok := apiShare(c, "stale_share", "0.05")
+	if !ok {
+		return
+	}
+	repo, ok := apiRepoStat(c)
+	if !ok {
+		return
+	}
+	rs := repo.Stat
+	if rs.Tree == nil {
+		apiError(c, http.StatusNotFound, "no_tree", "Repo was analyzed before directory stats were kept, POST to .../analyze?refresh=1")
+		return
+	}
+
+	rules := SuggestCodeOwners(rs, window, minShare)
+	if c.Query("format") == "text" {
+		header := fmt.Sprintf("Suggested from git blame of %s/%s/%s at %s\nOwners hold at least %d%% of the lines changed in %s", repo.Host, repo.Owner, repo.Name, rs.Commit, int(minShare*100), window)
+		c.String(http.StatusOK, FormatCodeOwners(rules, header))
+		return
+	}
+
+	stale, unknown := StaleCodeOwners(rs, ParseCodeOwners(rs.CodeOwners), window, staleShare)
+	c.JSON(http.StatusOK, gin.H{
+		"window":   window,
+		"rules":    rules,
+		"existing": rs.CodeOwnersPath,
+		"stale":    stale,
+		"unknown":  unknown,
+	})
+}
+
+func apiBusFactorHandler(c *gin.Context) {
+	inactiveDays, err := strconv.Atoi(c.DefaultQuery("inactive_days", strconv.Itoa(BUS_FACTOR_INACTIVE_DAYS)))
+	if err != nil || inactiveDays < 0 {
+		apiError(c, http.StatusBadRequest, "bad_inactive_days", "inactive_days must be a non-negative number")
+		return
+	}
+	minLines, err := strconv.Atoi(c.DefaultQuery("min_lines", strconv.Itoa(BUS_FACTOR_MIN_LINES)))
+	if err != nil || minLines < 0 {
+		apiError(c, http.StatusBadRequest, "bad_min_lines", "min_lines must be a non-negative number")
+		return
+	}
+	repo, ok := apiRepoStat(c)
+	if !ok {
+		return
+	}
+	rs := repo.Stat
+	if rs.Tree == nil {
+		apiError(c, http.StatusNotFound, "no_tree", "Repo was analyzed before directory stats were kept, POST to .../analyze?refresh=1")
+		return
+	}
+
+	users := make(map[string]*UserStat)
+	for _, u := range rs.Users {
+		users[u.Email] = u
+	}
+	report := AnalyzeBusFactor(rs, inactiveDays, minLines)
+	dirs := []ApiBusFactor{}
+	for _, d := range report.Dirs {
+		dirs = append(dirs, newApiBusFactor(d, users))
+	}
+	c.JSON(http.StatusOK, gin.H{"repo": newApiBusFactor(report.Repo, users), "directories": dirs})
+}
+
+func apiAnalyzeHandler(c *gin.Context) {
+	rc := apiRepoConfig(c)
+	if _, _, _, err := rc.ParseURL(); err != nil {
+		apiError(c, http.StatusBadRequest, "bad_repo", err.Error())
+		return
+	}
+	refresh := c.Query("refresh") != ""
+
+	repo := rc.Repo()
+	if !refresh && repo.getCachedStat() != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "ready", "hash": repo.Hash})
+		return
+	}
+	if _, err := workers.WorkerFor(repo.Hash); err != nil {
+		apiError(c, http.StatusServiceUnavailable, "worker_unavailable", err.Error())
+		return
+	}
+	repoQuery(rc, refresh)
+	c.JSON(http.StatusAccepted, gin.H{"status": "processing", "hash": repo.Hash})
+}
+
+// apiRepoEndpoints are served under /repos/{host}/{owner}/{name}/ by the method, the repo itself at ""
+var apiRepoEndpoints = map[string]map[string]gin.HandlerFunc{
+	"":             {"GET": apiRepoHandler},
+	"contributors": {"GET": apiContributorsHandler},
+	"extensions":   {"GET": apiExtensionsHandler},
+	"tree":         {"GET": apiTreeHandler},
+	"codeowners":   {"GET": apiCodeOwnersHandler},
+	"busfactor":    {"GET": apiBusFactorHandler},
+	"analyze":      {"POST": apiAnalyzeHandler},
+}
+
+// apiRepoRoute splits the path after /repos/{host}/ into the "repo" param, owner/name or group/subgroup/name,
+// and the endpoint the request goes to. The last segment is the endpoint only if it follows at least owner/name.
+// The router can't match an owner of several segments itself
+func apiRepoRoute(c *gin.Context) {
+	segments := strings.Split(strings.Trim(c.Param("path"), "/"), "/")
+	endpoint := ""
+	if n := len(segments); n > 2 {
+		if _, exists := apiRepoEndpoints[segments[n-1]]; exists {
+			segments, endpoint = segments[:n-1], segments[n-1]
+		}
+	}
+	handler, exists := apiRepoEndpoints[endpoint][c.Request.Method]
+	if !exists {
+		apiError(c, http.StatusNotFound, "not_found", "Unknown endpoint")
+		return
+	}
+	c.Params = append(c.Params, gin.Param{Key: "repo", Value: strings.Join(segments, "/")})
+	handler(c)
+}
+
+// apiRoutes registers the versioned API, documented in README.md
+func apiRoutes(r *gin.Engine) {
+	v1 := r.Group("/api/v1")
+	v1.GET("/repos/:host/*path", apiRepoRoute)
+	v1.POST("/repos/:host/*path", apiRepoRoute)
+}
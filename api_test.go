@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestApiRepoRoute(t *testing.T) {
+	defer func(endpoints map[string]map[string]gin.HandlerFunc) { apiRepoEndpoints = endpoints }(apiRepoEndpoints)
+	var url, endpoint string
+	handler := func(name string) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			url, endpoint = apiRepoConfig(c).URL, name
+			c.String(http.StatusOK, "ok")
+		}
+	}
+	apiRepoEndpoints = map[string]map[string]gin.HandlerFunc{
+		"":        {"GET": handler("repo")},
+		"tree":    {"GET": handler("tree")},
+		"analyze": {"POST": handler("analyze")},
+	}
+	r := gin.New()
+	apiRoutes(r)
+
+	tests := []struct {
+		method, path  string
+		status        int
+		url, endpoint string
+	}{
+		{"GET", "/api/v1/repos/github.com/owner/name", 200, "https://github.com/owner/name", "repo"},
+		{"GET", "/api/v1/repos/github.com/owner/name/", 200, "https://github.com/owner/name", "repo"},
+		{"GET", "/api/v1/repos/github.com/owner/name/tree", 200, "https://github.com/owner/name", "tree"},
+		{"POST", "/api/v1/repos/github.com/owner/name/analyze", 200, "https://github.com/owner/name", "analyze"},
+		{"GET", "/api/v1/repos/gitlab.com/group/sub/name", 200, "https://gitlab.com/group/sub/name", "repo"},
+		{"GET", "/api/v1/repos/gitlab.com/group/sub/name/tree", 200, "https://gitlab.com/group/sub/name", "tree"},
+		{"POST", "/api/v1/repos/gitlab.com/group/sub/deeper/name/analyze", 200, "https://gitlab.com/group/sub/deeper/name", "analyze"},
+		// a repo named like an endpoint
+		{"GET", "/api/v1/repos/github.com/owner/tree", 200, "https://github.com/owner/tree", "repo"},
+		{"GET", "/api/v1/repos/github.com/owner/name/analyze", 404, "", ""},
+		{"POST", "/api/v1/repos/github.com/owner/name", 404, "", ""},
+	}
+	for _, tt := range tests {
+		url, endpoint = "", ""
+		req, _ := http.NewRequest(tt.method, tt.path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status || url != tt.url || endpoint != tt.endpoint {
+			t.Errorf("%s %s: got %d %q %q, want %d %q %q", tt.method, tt.path, w.Code, url, endpoint, tt.status, tt.url, tt.endpoint)
+		}
+	}
+}
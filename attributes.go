@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var LINGUIST_ATTRS = []string{"linguist-vendored", "linguist-generated", "linguist-documentation", "linguist-language"}
+
+// AttrState is the state of a boolean gitattribute
+type AttrState int
+
+const (
+	AttrUnspecified AttrState = iota
+	AttrSet
+	AttrUnset
+)
+
+// FileAttrs holds linguist overrides declared in .gitattributes for a single file
+type FileAttrs struct {
+	Vendored      AttrState
+	Generated     AttrState
+	Documentation AttrState
+	Language      string
+}
+
+// linguist language names mapped to the extension we use for doc and comment classification
+var linguistLanguageExts = map[string]string{
+	"c": ".c", "c++": ".cpp", "c#": ".cs", "objective-c": ".m", "objective-c++": ".mm", "java": ".java",
+	"go": ".go", "rust": ".rs", "swift": ".swift", "kotlin": ".kt", "scala": ".scala", "dart": ".dart", "groovy": ".groovy",
+	"javascript": ".js", "typescript": ".ts", "coffeescript": ".coffee", "php": ".php",
+	"python": ".py", "ruby": ".rb", "perl": ".pl", "shell": ".sh", "powershell": ".ps1", "elixir": ".ex", "r": ".r",
+	"sql": ".sql", "plsql": ".sql", "lua": ".lua", "haskell": ".hs", "elm": ".elm", "ocaml": ".ml", "f#": ".fs",
+	"erlang": ".erl", "tex": ".tex", "emacs lisp": ".el", "common lisp": ".lisp", "clojure": ".clj", "scheme": ".scm", "racket": ".rkt",
+	"html": ".html", "xml": ".xml", "css": ".css", "scss": ".scss", "less": ".less",
+	"yaml": ".yml", "toml": ".toml", "ini": ".ini", "makefile": ".mk", "dockerfile": ".sh", "cmake": ".cmake",
+	"markdown": ".md", "text": ".txt",
+}
+
+// LanguageExt returns the extension of the language forced by linguist-language or an empty string
+func (a FileAttrs) LanguageExt() string {
+	return linguistLanguageExts[strings.ToLower(a.Language)]
+}
+
+// IsVendored reports whether the file is third-party code. Explicit attributes win over the built-in rules
+func (a FileAttrs) IsVendored(filePath string) bool {
+	switch a.Vendored {
+	case AttrSet:
+		return true
+	case AttrUnset:
+		return false
+	}
+	return depRegexp.MatchString(filePath)
+}
+
+func parseAttrState(info string) AttrState {
+	switch info {
+	case "unspecified", "":
+		return AttrUnspecified
+	case "unset", "false":
+		return AttrUnset
+	}
+	// "set", "true" or any other value
+	return AttrSet
+}
+
+// RepoCheckAttrs reads linguist attributes of the files at rev using `git check-attr`
+func RepoCheckAttrs(repoPath string, rev string, files []string) (map[string]FileAttrs, error) {
+	attrs := make(map[string]FileAttrs)
+	if len(files) == 0 {
+		return attrs, nil
+	}
+
+	// .gitattributes of rev are read through a throwaway index, the working tree may be at another commit
+	index, err := ioutil.TempFile("", "gitfluence-index")
+	if err != nil {
+		return nil, err
+	}
+	index.Close()
+	// git refuses to read an empty index file, read-tree creates it from scratch
+	os.Remove(index.Name())
+	defer os.Remove(index.Name())
+	env := append(os.Environ(), "GIT_INDEX_FILE="+index.Name())
+
+	cmd := exec.Command("git", "read-tree", rev)
+	cmd.Dir = repoPath
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	args := append([]string{"check-attr", "--cached", "-z", "--stdin"}, LINGUIST_ATTRS...)
+	cmd = exec.Command("git", args...)
+	cmd.Dir = repoPath
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = strings.NewReader(strings.Join(files, "\x00") + "\x00")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// -z output is a sequence of <path> NUL <attribute> NUL <info> NUL
+	f := bytes.Split(out, []byte{0})
+	for i := 0; i+2 < len(f); i += 3 {
+		file, attr, info := string(f[i]), string(f[i+1]), string(f[i+2])
+		a := attrs[file]
+		switch attr {
+		case "linguist-vendored":
+			a.Vendored = parseAttrState(info)
+		case "linguist-generated":
+			a.Generated = parseAttrState(info)
+		case "linguist-documentation":
+			a.Documentation = parseAttrState(info)
+		case "linguist-language":
+			if info != "unspecified" && info != "unset" && info != "set" {
+				a.Language = info
+			}
+		default:
+			return nil, fmt.Errorf("git check-attr: unexpected attribute %q for %s", attr, file)
+		}
+		attrs[file] = a
+	}
+
+	return attrs, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlameLine is a single line record from `git blame --line-porcelain` output
+type BlameLine struct {
+	Commit        string
+	OrigLine      int
+	FinalLine     int
+	Author        string
+	AuthorMail    string
+	AuthorTime    time.Time
+	Committer     string
+	CommitterMail string
+	CommitterTime time.Time
+	Summary       string
+	OrigPath      string
+	Boundary      bool
+	Content       string
+}
+
+// BlameParseError reports malformed blame output with the file and line where it happened
+type BlameParseError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *BlameParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// BlameParser reads `git blame --line-porcelain` output one line record at a time.
+// Records of a commit seen before may omit its keys as `--porcelain` does, they are taken from the first record
+type BlameParser struct {
+	r       *bufio.Reader
+	file    string
+	line    int
+	commits map[string]*BlameLine
+}
+
+func NewBlameParser(r io.Reader, file string) *BlameParser {
+	return &BlameParser{r: bufio.NewReaderSize(r, 64*1024), file: file, commits: make(map[string]*BlameLine)}
+}
+
+// isObjectName checks for a SHA-1 or SHA-256 object name
+func isObjectName(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *BlameParser) errorf(format string, args ...interface{}) error {
+	return &BlameParseError{File: p.file, Line: p.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *BlameParser) readLine() (string, error) {
+	s, err := p.r.ReadString('\n')
+	if err == io.EOF && len(s) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(s, "\n"), nil
+}
+
+// Next returns the next blamed line or io.EOF when the output is over
+func (p *BlameParser) Next() (*BlameLine, error) {
+	header, err := p.readLine()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	p.line++
+	if err != nil {
+		return nil, p.errorf("read error: %v", err)
+	}
+
+	// <sha> <orig line> <final line> [<lines in group>]
+	f := strings.Fields(header)
+	if len(f) < 3 || !isObjectName(f[0]) {
+		return nil, p.errorf("bad header %q", header)
+	}
+	bl := BlameLine{Commit: f[0]}
+	if bl.OrigLine, err = strconv.Atoi(f[1]); err != nil {
+		return nil, p.errorf("bad original line number %q", f[1])
+	}
+	if bl.FinalLine, err = strconv.Atoi(f[2]); err != nil {
+		return nil, p.errorf("bad final line number %q", f[2])
+	}
+
+	hasKeys := false
+	for {
+		s, err := p.readLine()
+		if err == io.EOF {
+			return nil, p.errorf("unexpected end of output for commit %s", bl.Commit)
+		}
+		if err != nil {
+			return nil, p.errorf("read error: %v", err)
+		}
+
+		if strings.HasPrefix(s, "\t") {
+			bl.Content = s[1:]
+			if seen, exists := p.commits[bl.Commit]; exists && !hasKeys {
+				bl.Author, bl.AuthorMail, bl.AuthorTime = seen.Author, seen.AuthorMail, seen.AuthorTime
+				bl.Committer, bl.CommitterMail, bl.CommitterTime = seen.Committer, seen.CommitterMail, seen.CommitterTime
+				bl.Summary, bl.Boundary = seen.Summary, seen.Boundary
+				if bl.OrigPath == "" {
+					bl.OrigPath = seen.OrigPath
+				}
+			} else if !exists {
+				seen := bl
+				p.commits[bl.Commit] = &seen
+			}
+			return &bl, nil
+		}
+
+		key, value := s, ""
+		if i := strings.IndexByte(s, ' '); i > -1 {
+			key, value = s[:i], s[i+1:]
+		}
+
+		switch key {
+		case "author":
+			hasKeys = true
+			bl.Author = value
+		case "author-mail":
+			bl.AuthorMail = strings.TrimSuffix(strings.TrimPrefix(value, "<"), ">")
+		case "author-time":
+			t, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, p.errorf("bad author-time %q", value)
+			}
+			bl.AuthorTime = time.Unix(t, 0)
+		case "committer":
+			bl.Committer = value
+		case "committer-mail":
+			bl.CommitterMail = strings.TrimSuffix(strings.TrimPrefix(value, "<"), ">")
+		case "committer-time":
+			t, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, p.errorf("bad committer-time %q", value)
+			}
+			bl.CommitterTime = time.Unix(t, 0)
+		case "summary":
+			bl.Summary = value
+		case "filename":
+			bl.OrigPath = value
+		case "boundary":
+			bl.Boundary = true
+		}
+		// author-tz, committer-tz, previous and unknown keys are ignored
+	}
+}
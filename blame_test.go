@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the commits of the testdata/blame fixtures, made by blaming "my file.txt" after two commits
+var (
+	blameAlice = BlameLine{Author: "Alice Smith", AuthorMail: "alice@example.com", AuthorTime: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Committer: "Alice Smith", CommitterMail: "alice@example.com", CommitterTime: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Summary: "first", OrigPath: "my file.txt", Boundary: true}
+	blameBob = BlameLine{Author: "Bob", AuthorMail: "bob@example.com", AuthorTime: time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC),
+		Committer: "Bob", CommitterMail: "bob@example.com", CommitterTime: time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC),
+		Summary: "second change", OrigPath: "my file.txt"}
+)
+
+func blameFixture(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile("testdata/blame/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func parseBlame(output string) ([]*BlameLine, error) {
+	p := NewBlameParser(strings.NewReader(output), "my file.txt")
+	var lines []*BlameLine
+	for {
+		bl, err := p.Next()
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+		lines = append(lines, bl)
+	}
+}
+
+func TestBlameParser(t *testing.T) {
+	tests := []struct {
+		fixture     string
+		aliceCommit string
+		bobCommit   string
+	}{
+		{"line-porcelain-sha1.txt", "6f4ee095be560bb4dabfd672f237cbbd8d034fbe", "069a4b49d32c5e19ac6a6fa1123895069d69ef0c"},
+		{"line-porcelain-sha256.txt", "cabce3bdbfd059262511fee4b8a9797bee99c9cb805e9beb4a6ab31f0c749da9", "0bb6886d89791de1fddae8cc752bea0b9c06e514d8b1d774a5c2b131cf54bf1a"},
+		// the keys of commits seen before are omitted
+		{"porcelain-sha1.txt", "6f4ee095be560bb4dabfd672f237cbbd8d034fbe", "069a4b49d32c5e19ac6a6fa1123895069d69ef0c"},
+	}
+	for _, tt := range tests {
+		lines, err := parseBlame(blameFixture(t, tt.fixture))
+		if err != nil {
+			t.Errorf("%s: %v", tt.fixture, err)
+			continue
+		}
+		want := []BlameLine{blameAlice, blameBob, blameAlice, blameBob}
+		for i, content := range []string{"one", "TWO", "three", "four"} {
+			commit := tt.aliceCommit
+			if want[i].Author == blameBob.Author {
+				commit = tt.bobCommit
+			}
+			want[i].Commit, want[i].OrigLine, want[i].FinalLine, want[i].Content = commit, i+1, i+1, content
+		}
+		if len(lines) != len(want) {
+			t.Errorf("%s: got %d lines, want %d", tt.fixture, len(lines), len(want))
+			continue
+		}
+		for i, bl := range lines {
+			if !bl.AuthorTime.Equal(want[i].AuthorTime) || !bl.CommitterTime.Equal(want[i].CommitterTime) {
+				t.Errorf("%s: line %d times %v %v, want %v %v", tt.fixture, i+1, bl.AuthorTime, bl.CommitterTime, want[i].AuthorTime, want[i].CommitterTime)
+			}
+			got := *bl
+			got.AuthorTime, got.CommitterTime = want[i].AuthorTime, want[i].CommitterTime
+			if got != want[i] {
+				t.Errorf("%s: line %d\ngot  %+v\nwant %+v", tt.fixture, i+1, got, want[i])
+			}
+		}
+	}
+}
+
+func TestBlameParserErrors(t *testing.T) {
+	full := blameFixture(t, "line-porcelain-sha1.txt")
+	tests := []struct {
+		name   string
+		output string
+		lines  int // parsed before the error
+	}{
+		{"truncated in the keys", full[:strings.Index(full, "summary second")], 1},
+		{"truncated before the content", full[:strings.Index(full, "\tTWO")], 1},
+		{"truncated in the header", full[:strings.Index(full, "069a4b49")+20], 1},
+		{"abbreviated commit", "6f4ee09 1 1 1\n\tone\n", 0},
+		{"not hex", strings.Repeat("g", 40) + " 1 1 1\n\tone\n", 0},
+		{"missing line numbers", "6f4ee095be560bb4dabfd672f237cbbd8d034fbe 1\n\tone\n", 0},
+		{"bad line number", "6f4ee095be560bb4dabfd672f237cbbd8d034fbe x 1 1\n\tone\n", 0},
+		{"bad author-time", "6f4ee095be560bb4dabfd672f237cbbd8d034fbe 1 1 1\nauthor-time soon\n\tone\n", 0},
+	}
+	for _, tt := range tests {
+		lines, err := parseBlame(tt.output)
+		if _, ok := err.(*BlameParseError); !ok {
+			t.Errorf("%s: got error %v, want a parse error", tt.name, err)
+		}
+		if len(lines) != tt.lines {
+			t.Errorf("%s: parsed %d lines before the error, want %d", tt.name, len(lines), tt.lines)
+		}
+	}
+
+	// the output may end without a newline after the last line
+	lines, err := parseBlame(strings.TrimSuffix(full, "\n"))
+	if err != nil || len(lines) != 4 || lines[3].Content != "four" {
+		t.Errorf("got %d lines, %v without the last newline", len(lines), err)
+	}
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"hash/fnv"
+	"image/png"
 	"math"
 	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
 
 	"sort"
 
 	"io"
 
+	log "github.com/Sirupsen/logrus"
 	svg "github.com/ajstarks/svgo"
 	"github.com/gin-gonic/gin"
 )
@@ -28,8 +35,33 @@ const (
 	TownCode TownType = iota
 	TownDocs
 	TownTests
+	TownResources // images, fonts and other binary files
 )
 
+// TOWN_TYPES are the districts in the drawing order
+var TOWN_TYPES = []TownType{TownCode, TownDocs, TownTests, TownResources}
+
+var TOWN_NAMES = map[TownType]string{TownCode: "Code", TownDocs: "Docs", TownTests: "Tests", TownResources: "Resources"}
+
+// ParseTownTypes reads a comma-separated list of case-insensitive district names
+func ParseTownTypes(names string) ([]TownType, error) {
+	var towns []TownType
+	for _, name := range strings.Split(names, ",") {
+		found := false
+		for _, townType := range TOWN_TYPES {
+			if strings.EqualFold(TOWN_NAMES[townType], strings.TrimSpace(name)) {
+				towns = append(towns, townType)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown district %q", name)
+		}
+	}
+	return towns, nil
+}
+
 type ByZIndex []Tower
 
 func (a ByZIndex) Len() int      { return len(a) }
@@ -38,26 +70,30 @@ func (a ByZIndex) Less(i, j int) bool {
 	return a[i].ZIndex < a[j].ZIndex
 }
 
-func random(from, to int) int {
+func random(rnd *rand.Rand, from, to int) int {
 	if from >= to {
 		return from
 	}
-	return rand.Intn(to-from) + from
+	return rnd.Intn(to-from) + from
 }
 
 func Round(f float64) int {
 	return int(math.Floor(f + .5))
 }
 
-func randColorGrey() (int, int, int) {
-	r := random(190, 210)
-	g := r + random(-10, 10)
-	b := r + random(-10, 10)
+func randColorGrey(rnd *rand.Rand) (int, int, int) {
+	r := random(rnd, 190, 210)
+	g := r + random(rnd, -10, 10)
+	b := r + random(rnd, -10, 10)
 	return r, g, b
 }
 
-func randColorPastelle() (int, int, int) {
-	return rand.Intn(128) + 127, rand.Intn(128) + 127, rand.Intn(128) + 127
+// userColor is a pastel color derived from the identity, so a user has the same color in every image
+func userColor(email string) (int, int, int) {
+	h := fnv.New32a()
+	h.Write([]byte(email))
+	sum := h.Sum32()
+	return int(sum&0x7f) + 127, int(sum>>8&0x7f) + 127, int(sum>>16&0x7f) + 127
 }
 
 func lightColor(r, g, b int, k float64) (int, int, int) {
@@ -104,32 +140,141 @@ func fill(r, g, b int) string {
 
 	canvas.End()
 }*/
+// DrawOptions select what is drawn over the town
+type DrawOptions struct {
+	BusFactor bool       // mark towers of the key contributors and of inactive single owners
+	Seed      int64      // places the towers, the seed of the repo if 0
+	Legend    bool       // colors of the top users
+	Districts []TownType // all if empty
+	Window    string     // towers stand for the lines of the window returned by ParseWindow, Total if empty
+}
+
+// drawOptions reads the options of /draw and /draw.png, false if the response is written already
+func drawOptions(c *gin.Context) (DrawOptions, bool) {
+	opts := DrawOptions{BusFactor: c.Query("overlay") == "busfactor", Legend: c.Query("legend") == "1"}
+	if seed, err := strconv.ParseInt(c.Query("seed"), 10, 64); err == nil {
+		opts.Seed = seed
+	}
+	if window := c.Query("window"); window != "" {
+		var ok bool
+		if opts.Window, ok = ParseWindow(window); !ok {
+			c.String(http.StatusBadRequest, "Unknown window "+window)
+			return opts, false
+		}
+	}
+	if districts := c.Query("districts"); districts != "" {
+		var err error
+		if opts.Districts, err = ParseTownTypes(districts); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return opts, false
+		}
+	}
+	return opts, true
+}
+
+// drawnRepo returns the analyzed repo of /draw and /draw.png with its stat, false if the response is written already
+func drawnRepo(c *gin.Context) (*Repo, bool) {
+	repoURL, err := repoURLFromInput(c.Query("repo"))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "bad_repo", err.Error())
+		return nil, false
+	}
+	rc := RepoConfig{URL: repoURL, Ref: c.Query("ref"), AsOf: c.Query("asof")}
+	repo := rc.Repo()
+	if repo.Stat = repo.getCachedStat(); repo.Stat == nil {
+		apiError(c, http.StatusNotFound, "not_analyzed", "Repo is not analyzed, POST to /api/v1/.../analyze first")
+		return nil, false
+	}
+	return repo, true
+}
+
 func drawRepoHandler(c *gin.Context) {
+	opts, ok := drawOptions(c)
+	if !ok {
+		return
+	}
+	repo, ok := drawnRepo(c)
+	if !ok {
+		return
+	}
 	c.Writer.Header().Set("Content-type", "image/svg+xml")
+	repo.DrawStat(c.Writer, repo.Stat, opts)
+}
 
-	rc := RepoConfig{URL: c.Query("repo")}
+// drawPNGHandler rasterizes the image of /draw, scale multiplies its size
+func drawPNGHandler(c *gin.Context) {
+	opts, ok := drawOptions(c)
+	if !ok {
+		return
+	}
+	scale, err := strconv.ParseFloat(c.DefaultQuery("scale", "1"), 64)
+	if err != nil || scale <= 0 || scale > RASTER_MAX_SCALE {
+		c.String(http.StatusBadRequest, "scale must be a number up to "+strconv.Itoa(RASTER_MAX_SCALE))
+		return
+	}
+	repo, ok := drawnRepo(c)
+	if !ok {
+		return
+	}
 
-	rc.Repo().Draw(c.Writer)
+	b := bytes.Buffer{}
+	repo.DrawStat(&b, repo.Stat, opts)
+	img, err := RasterizeSVG(&b, scale)
+	if err != nil {
+		log.WithError(err).Error("Can't rasterize")
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	out := bytes.Buffer{}
+	if err = png.Encode(&out, img); err != nil {
+		log.WithError(err).Error("Can't encode PNG")
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Data(http.StatusOK, "image/png", out.Bytes())
 }
 
-func (repo *Repo) Draw(w io.Writer) {
-	canvas := svg.New(w)
-	canvas.Start(CANVAS_WIDTH, CANVAS_HEIGHT)
-	canvas.Title(repo.Owner + "/" + repo.Name)
+// Seed is derived from the repo hash, so the repo looks the same on every render
+func (repo *Repo) Seed() int64 {
+	h := fnv.New64a()
+	h.Write([]byte(repo.Hash))
+	return int64(h.Sum64())
+}
 
-	drawFloor(canvas)
+func (repo *Repo) Draw(w io.Writer, opts DrawOptions) {
+	repo.DrawStat(w, repo.getCachedStat(), opts)
+}
 
-	rs := repo.getCachedStat()
+// DrawStat renders the stat, the same stat and options always give the same image
+func (repo *Repo) DrawStat(w io.Writer, rs *RepoStat, opts DrawOptions) {
+	seed := opts.Seed
+	if seed == 0 {
+		seed = repo.Seed()
+	}
+	rnd := rand.New(rand.NewSource(seed))
 
-	sort.Sort(ByCodeLines(rs.Users))
+	canvas := svg.New(w)
+	canvas.Start(CANVAS_WIDTH, CANVAS_HEIGHT)
+	canvas.Title(repo.Owner + "/" + repo.Name)
 
-	field := getField(canvas)
+	drawFloor(canvas, rnd)
 
-	field.addUsersTowers(TownCode, rs)
+	window := opts.Window
+	if window == "" {
+		window = "Total"
+	}
+	sort.Sort(ByWindowCodeLines{Users: rs.Users, Window: window})
 
-	field.addUsersTowers(TownDocs, rs)
+	field := getField(canvas, rnd)
 
-	field.addUsersTowers(TownTests, rs)
+	towns := opts.Districts
+	if len(towns) == 0 {
+		towns = TOWN_TYPES
+	}
+	for _, townType := range towns {
+		field.addUsersTowers(townType, rs, window)
+	}
+	drawDistrictLabels(canvas, field, towns)
 
 	for i, u := range rs.Users {
 		//field.addTower(TownCode, u)
@@ -145,7 +290,15 @@ func (repo *Repo) Draw(w io.Writer) {
 		x, y := tower.Cell.Pos()
 
 		fmt.Printf("Tower zindex=%v id=%v w=%v z=%v h=%v x=%v y=%v color %+v\n", tower.ZIndex, tower.Cell.ID, tower.W, tower.Z, tower.H, x, y, tower.Color)
-		drawCube(field.Canvas, x+CELL_PADDING*int((tower.Cell.ID%CELLS_SIDE)), y+CELL_PADDING*int((tower.Cell.ID/CELLS_SIDE)), tower.W*CellSize, tower.H*CellSize, tower.Z*CellSize, tower.Color.R, tower.Color.G, tower.Color.B, tower.Email)
+		drawCube(field.Canvas, x+CELL_PADDING*int((tower.Cell.ID%CELLS_SIDE)), y+CELL_PADDING*int((tower.Cell.ID/CELLS_SIDE)), tower.W*CellSize, tower.H*CellSize, tower.Z*CellSize, tower.Color.R, tower.Color.G, tower.Color.B, tower.Email, tower.Title)
+	}
+
+	drawTitleBlock(canvas, repo, rs, window)
+	if opts.Legend {
+		drawLegend(canvas, field, rs, towns, window)
+	}
+	if opts.BusFactor {
+		drawBusFactor(canvas, field, rs)
 	}
 
 	canvas.End()
@@ -164,11 +317,23 @@ type Tower struct {
 	Z      int
 	H      int
 	Email  string
+	Title  string // shown on hover
 	Color  Color
 	Cell   *Cell
 }
+
+// Top returns the center of the tower roof on the canvas
+func (t *Tower) Top() (x, y int) {
+	w := t.W * CellSize / 4
+	z := t.Z * CellSize / 4
+	cx, cy := t.Cell.Pos()
+	x, y = isoPos(cx+CELL_PADDING*(t.Cell.ID%CELLS_SIDE), cy+CELL_PADDING*(t.Cell.ID/CELLS_SIDE), t.H*CellSize)
+	return x + (p(z)-p(w))/2, y + z + w
+}
+
 type Field struct {
 	Canvas    *svg.SVG
+	Rand      *rand.Rand // all randomness of the layout, seeded per repo
 	FreeCells map[TownType][]int
 	Building  map[int]int // number of floors
 	CellType  map[int]TownType
@@ -188,24 +353,29 @@ type Cell struct {
 var FieldSideSize = CANVAS_WIDTH * WIDTH_TO_SIDE
 var CellSize = int(FieldSideSize/CELLS_SIDE) - CELL_PADDING
 
-func getField(canvas *svg.SVG) *Field {
-	f := Field{Canvas: canvas}
+func getField(canvas *svg.SVG, rnd *rand.Rand) *Field {
+	f := Field{Canvas: canvas, Rand: rnd}
 	f.CellType = make(map[int]TownType)
 	f.Building = make(map[int]int)
 	f.FreeCells = make(map[TownType][]int)
-	for i := 1; i <= 40; i++ {
+	for i := 1; i <= 35; i++ {
 		f.FreeCells[TownCode] = append(f.FreeCells[TownCode], i)
 		f.CellType[i] = TownCode
 	}
-	for i := 51; i <= 70; i++ {
+	for i := 46; i <= 60; i++ {
 		f.FreeCells[TownDocs] = append(f.FreeCells[TownDocs], i)
 		f.CellType[i] = TownDocs
 	}
 
-	for i := 81; i <= 100; i++ {
+	for i := 66; i <= 80; i++ {
 		f.FreeCells[TownTests] = append(f.FreeCells[TownTests], i)
 		f.CellType[i] = TownTests
 	}
+
+	for i := 86; i <= 100; i++ {
+		f.FreeCells[TownResources] = append(f.FreeCells[TownResources], i)
+		f.CellType[i] = TownResources
+	}
 	return &f
 
 }
@@ -222,7 +392,7 @@ func (f *Field) getFreeCell(townType TownType) *Cell {
 	if len(f.FreeCells[townType]) == 0 {
 		return nil
 	}
-	cell := Cell{ID: f.FreeCells[townType][random(0, len(f.FreeCells[townType])-1)], Field: f}
+	cell := Cell{ID: f.FreeCells[townType][random(f.Rand, 0, len(f.FreeCells[townType])-1)], Field: f}
 
 	for (cell.ID+cell.MaxW) <= (cell.ID/CELLS_SIDE+CELLS_SIDE) && !f.isCellUsed(cell.ID+cell.MaxW) && f.isCellOfType(cell.ID+cell.MaxW, townType) {
 		cell.MaxW++
@@ -270,29 +440,49 @@ func (c *Cell) Use(w, z, h int) {
 
 }
 
-func getUserTotal(us *UserStat, townType TownType) int {
+func getUserTotal(us *UserStat, townType TownType, window string) int {
 	if townType == TownCode {
-		return us.CodeLines.Total
+		return us.CodeLines.Window(window)
 	} else if townType == TownDocs {
-		return us.DocLines.Total
+		return us.DocLines.Window(window)
 	} else if townType == TownTests {
-		return us.TestLines.Total
+		return us.TestLines.Window(window)
+	} else if townType == TownResources {
+		return us.Resources.Window(window)
 	}
 	return 0
 }
 
-func getRepoTotal(us *RepoStat, townType TownType) int {
+func getRepoTotal(us *RepoStat, townType TownType, window string) int {
 	if townType == TownCode {
-		return us.CodeLines.Total
+		return us.CodeLines.Window(window)
 	} else if townType == TownDocs {
-		return us.DocLines.Total
+		return us.DocLines.Window(window)
 	} else if townType == TownTests {
-		return us.TestLines.Total
+		return us.TestLines.Window(window)
+	} else if townType == TownResources {
+		return us.Resources.Window(window)
 	}
 	return 0
 }
 
-func (f *Field) addUsersTowers(townType TownType, rs *RepoStat) {
+// ByWindowCodeLines sorts users by the code lines of the window
+type ByWindowCodeLines struct {
+	Users  []*UserStat
+	Window string
+}
+
+func (a ByWindowCodeLines) Len() int      { return len(a.Users) }
+func (a ByWindowCodeLines) Swap(i, j int) { a.Users[i], a.Users[j] = a.Users[j], a.Users[i] }
+func (a ByWindowCodeLines) Less(i, j int) bool {
+	return a.Users[i].CodeLines.Window(a.Window) > a.Users[j].CodeLines.Window(a.Window)
+}
+
+func (f *Field) addUsersTowers(townType TownType, rs *RepoStat, window string) {
+	// repos without resources are common, the district stays empty
+	if getRepoTotal(rs, townType, window) == 0 {
+		return
+	}
 
 	totalUsers := 10
 	if len(rs.Users) < 10 {
@@ -303,27 +493,29 @@ func (f *Field) addUsersTowers(townType TownType, rs *RepoStat) {
 
 	userLines := 0
 	userVolume := 0.0
-	downscale := float64(getRepoTotal(rs, townType)) / 500
+	downscale := float64(getRepoTotal(rs, townType, window)) / 500
 
 	for i, us := range rs.Users[0 : totalUsers-1] {
 		volume = 0
 		if us.Color.R > 0 {
 			r, g, b = us.Color.R, us.Color.B, us.Color.G
 		} else {
-			r, g, b = randColorPastelle()
+			r, g, b = userColor(us.Email)
 		}
 		fmt.Printf("Adding tower for user %v r=%v g=%v b=%v \n", us.Email, r, g, b)
-		if i == 0 {
+		// the top code owners may have no lines in the district
+		if i == 0 || getUserTotal(rs.Users[i-1], townType, window) == 0 {
 
-			totalVolume = float64(getUserTotal(us, townType)) / (500.0 * downscale)
+			totalVolume = float64(getUserTotal(us, townType, window)) / (500.0 * downscale)
 			if totalVolume > 30 {
 				totalVolume = 30
 			}
 
 		} else {
-			totalVolume = totalVolume * float64(getUserTotal(us, townType)) / float64(getUserTotal(rs.Users[i-1], townType))
+			totalVolume = totalVolume * float64(getUserTotal(us, townType, window)) / float64(getUserTotal(rs.Users[i-1], townType, window))
 		}
-		userLines += getUserTotal(us, townType)
+		userLines += getUserTotal(us, townType, window)
+		title := towerTitle(userName(us), getUserTotal(us, townType, window), getRepoTotal(rs, townType, window), townType)
 
 		for volume < totalVolume {
 			cell := f.getFreeCell(townType)
@@ -335,9 +527,9 @@ func (f *Field) addUsersTowers(townType TownType, rs *RepoStat) {
 
 			var h int
 			if y == 0 || x == 0 {
-				h = random(2, 10)
+				h = random(f.Rand, 2, 10)
 			} else {
-				h = random(1, 6)
+				h = random(f.Rand, 1, 6)
 			}
 			if y == 0 || x == 0 || x > int(FieldSideSize)-CellSize || y > int(FieldSideSize)-CellSize {
 				if cell.MaxW > 3 {
@@ -355,8 +547,8 @@ func (f *Field) addUsersTowers(townType TownType, rs *RepoStat) {
 					cell.MaxZ = 2
 				}
 			}
-			w := random(1, cell.MaxW)
-			z := random(1, cell.MaxZ)
+			w := random(f.Rand, 1, cell.MaxW)
+			z := random(f.Rand, 1, cell.MaxZ)
 
 			if float64(w*h*z) > totalVolume*1.3 {
 				if z > 2 {
@@ -372,15 +564,20 @@ func (f *Field) addUsersTowers(townType TownType, rs *RepoStat) {
 			cell.Use(w, z, h)
 			//us.Color = Color{R: r, G: g, B: b}
 			fmt.Printf("Adding tower for user %v r=%v g=%v b=%v \n", us.Email, r, g, b)
-			f.Towers = append(f.Towers, Tower{Email: us.Email, ZIndex: cell.ZIndex, W: w, Z: z, H: h, Cell: cell, Color: Color{R: r, G: g, B: b}})
+			f.Towers = append(f.Towers, Tower{Email: us.Email, Title: title, ZIndex: cell.ZIndex, W: w, Z: z, H: h, Cell: cell, Color: Color{R: r, G: g, B: b}})
 		}
 		userVolume += volume
 	}
 
-	totalVolume = userVolume * (float64(getRepoTotal(rs, townType)) / float64(userLines))
+	totalVolume = userVolume * (float64(getRepoTotal(rs, townType, window)) / float64(userLines))
+	if userLines == 0 {
+		// nobody on top has lines in the district, the others own all of it
+		totalVolume = float64(getRepoTotal(rs, townType, window)) / (500.0 * downscale)
+	}
 	volume = 0
+	title := towerTitle("Other contributors", getRepoTotal(rs, townType, window)-userLines, getRepoTotal(rs, townType, window), townType)
 	for volume < totalVolume {
-		r, g, b = randColorGrey()
+		r, g, b = randColorGrey(f.Rand)
 		cell := f.getFreeCell(townType)
 
 		if cell == nil {
@@ -390,9 +587,9 @@ func (f *Field) addUsersTowers(townType TownType, rs *RepoStat) {
 
 		var h int
 		if y == 0 || x == 0 {
-			h = random(4, 9)
+			h = random(f.Rand, 4, 9)
 		} else {
-			h = random(1, 6)
+			h = random(f.Rand, 1, 6)
 		}
 		if y == 0 || x == 0 || x > int(FieldSideSize)-CellSize || y > int(FieldSideSize)-CellSize {
 			if cell.MaxW > 3 {
@@ -410,8 +607,8 @@ func (f *Field) addUsersTowers(townType TownType, rs *RepoStat) {
 				cell.MaxZ = 2
 			}
 		}
-		w := random(1, cell.MaxW)
-		z := random(1, cell.MaxZ)
+		w := random(f.Rand, 1, cell.MaxW)
+		z := random(f.Rand, 1, cell.MaxZ)
 
 		if float64(w*h*z) > totalVolume*1.3 {
 			if z > 2 {
@@ -427,23 +624,32 @@ func (f *Field) addUsersTowers(townType TownType, rs *RepoStat) {
 		cell.Use(w, z, h)
 		//us.Color = Color{R: r, G: g, B: b}
 		fmt.Printf("Adding tower for anon \n")
-		f.Towers = append(f.Towers, Tower{ZIndex: cell.ZIndex, W: w, Z: z, H: h, Cell: cell, Color: Color{R: r, G: g, B: b}})
+		f.Towers = append(f.Towers, Tower{Title: title, ZIndex: cell.ZIndex, W: w, Z: z, H: h, Cell: cell, Color: Color{R: r, G: g, B: b}})
 	}
 
 }
 
-func drawCube(canvas *svg.SVG, xt, yt, w, h, z, r, g, b int, id string) {
-	w = int(w / 4)
-	z = int(z / 4)
-	y := CANVAS_HEIGHT - int(CANVAS_WIDTH*(1/m3)) - h
-	x := CANVAS_WIDTH / 2
+// isoPos projects the field point at the height h to the canvas
+func isoPos(xt, yt, h int) (x, y int) {
+	y = CANVAS_HEIGHT - int(CANVAS_WIDTH*(1/m3)) - h
+	x = CANVAS_WIDTH / 2
 
 	x -= int((m3 / 2) * float64(xt))
 	y += int(xt / 2)
 
 	x += int((m3 / 2) * float64(yt))
 	y += int(yt / 2)
+	return x, y
+}
+
+func drawCube(canvas *svg.SVG, xt, yt, w, h, z, r, g, b int, id, title string) {
+	w = int(w / 4)
+	z = int(z / 4)
+	x, y := isoPos(xt, yt, h)
 	canvas.Gid(id)
+	if title != "" {
+		canvas.Title(title)
+	}
 	tx := []int{x, x + p(z), x - p(w) + p(z), x - p(w), x}
 	ty := []int{y, y + z*2, y + (z+w)*2, y + w*2, y}
 	canvas.Polygon(tx, ty, fill(lightColor(r, g, b, 0.1)))
@@ -459,8 +665,8 @@ func drawCube(canvas *svg.SVG, xt, yt, w, h, z, r, g, b int, id string) {
 	canvas.Gend()
 }
 
-func drawFloor(canvas *svg.SVG) {
-	r, g, b := random(190, 196), random(190, 240), random(60, 72)
+func drawFloor(canvas *svg.SVG, rnd *rand.Rand) {
+	r, g, b := random(rnd, 190, 196), random(rnd, 190, 240), random(rnd, 60, 72)
 	t := 1 / m3
 	x := int(CANVAS_WIDTH / 2)
 	y := CANVAS_HEIGHT - int(CANVAS_WIDTH*t)
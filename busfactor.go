@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	svg "github.com/ajstarks/svgo"
+)
+
+// key contributors own more than that share of the code lines together
+const BUS_FACTOR_SHARE = 0.5
+
+// defaults of the API and the thresholds of the SVG overlay
+const BUS_FACTOR_INACTIVE_DAYS = 180
+const BUS_FACTOR_MIN_LINES = 100
+
+// the overlay lists that many inactive directories at most
+const BUS_FACTOR_MAX_LISTED = 5
+
+// BusOwner is a key contributor, Email matches UserStat.Email
+type BusOwner struct {
+	Email string
+	Lines int
+}
+
+type ByBusOwnerLines []BusOwner
+
+func (a ByBusOwnerLines) Len() int      { return len(a) }
+func (a ByBusOwnerLines) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByBusOwnerLines) Less(i, j int) bool {
+	if a[i].Lines != a[j].Lines {
+		return a[i].Lines > a[j].Lines
+	}
+	return a[i].Email < a[j].Email
+}
+
+// BusFactor is the smallest set of contributors owning more than half of the code of the repo or a directory
+type BusFactor struct {
+	Path      string
+	CodeLines int
+	Owners    []BusOwner // the bus factor is their number
+	// the code is owned by a single person who hasn't changed it for InactiveDays
+	Inactive     bool
+	InactiveDays int
+}
+
+// BusFactorReport covers the repo and its directories, parents first
+type BusFactorReport struct {
+	Repo BusFactor
+	Dirs []BusFactor
+}
+
+// keyOwners picks the owners with the most lines until they hold more than BUS_FACTOR_SHARE of total
+func keyOwners(owners []BusOwner, total int) []BusOwner {
+	sort.Sort(ByBusOwnerLines(owners))
+	key := []BusOwner{}
+	lines := 0
+	for _, o := range owners {
+		if float64(lines) > BUS_FACTOR_SHARE*float64(total) || o.Lines == 0 {
+			break
+		}
+		key = append(key, o)
+		lines += o.Lines
+	}
+	return key
+}
+
+type busFactorAnalyzer struct {
+	users        map[string]*UserStat
+	inactiveDays int
+	minLines     int
+	now          time.Time
+	report       BusFactorReport
+}
+
+func (a *busFactorAnalyzer) busFactor(dirPath string, total int, owners []BusOwner) BusFactor {
+	bf := BusFactor{Path: dirPath, CodeLines: total, Owners: keyOwners(owners, total)}
+	if len(bf.Owners) == 1 {
+		// CommitDays is the age of the oldest line, activity is judged by the newest one.
+		// Stats analyzed before the newest line was kept can't tell
+		u, exists := a.users[bf.Owners[0].Email]
+		if exists && !u.LastCommitTime.IsZero() {
+			if days := int(a.now.Sub(u.LastCommitTime).Hours() / 24); days >= a.inactiveDays {
+				bf.Inactive = true
+				bf.InactiveDays = days
+			}
+		}
+	}
+	return bf
+}
+
+func (a *busFactorAnalyzer) walk(d *DirStat, dirPath string) {
+	for _, child := range d.Children {
+		if child.File || child.CodeLines.Total < a.minLines {
+			continue
+		}
+		childPath := path.Join(dirPath, child.Name)
+		var owners []BusOwner
+		for _, u := range child.Users {
+			owners = append(owners, BusOwner{Email: u.Email, Lines: u.CodeLines.Total})
+		}
+		a.report.Dirs = append(a.report.Dirs, a.busFactor(childPath, child.CodeLines.Total, owners))
+		a.walk(child, childPath)
+	}
+}
+
+// AnalyzeBusFactor computes the bus factor of the repo and of every directory with at least minLines of code.
+// Single owners whose newest line is inactiveDays old or older now are flagged
+func AnalyzeBusFactor(rs *RepoStat, inactiveDays, minLines int) *BusFactorReport {
+	a := busFactorAnalyzer{users: make(map[string]*UserStat), inactiveDays: inactiveDays, minLines: minLines, now: time.Now()}
+	var owners []BusOwner
+	for _, u := range rs.Users {
+		a.users[u.Email] = u
+		owners = append(owners, BusOwner{Email: u.Email, Lines: u.CodeLines.Total})
+	}
+	a.report.Repo = a.busFactor("", rs.CodeLines.Total, owners)
+	a.report.Dirs = []BusFactor{}
+	if rs.Tree != nil {
+		a.walk(rs.Tree, "")
+	}
+	return &a.report
+}
+
+// Inactive returns the flagged directories, the repo included
+func (r *BusFactorReport) Inactive() []BusFactor {
+	var res []BusFactor
+	if r.Repo.Inactive {
+		res = append(res, r.Repo)
+	}
+	for _, d := range r.Dirs {
+		if d.Inactive {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// drawBusFactor rings the towers of the key contributors of the repo, red for single owners who went inactive,
+// and lists the bus factor with the inactive directories under the title block
+func drawBusFactor(canvas *svg.SVG, field *Field, rs *RepoStat) {
+	report := AnalyzeBusFactor(rs, BUS_FACTOR_INACTIVE_DAYS, BUS_FACTOR_MIN_LINES)
+	inactive := report.Inactive()
+
+	marks := make(map[string]string)
+	for _, o := range report.Repo.Owners {
+		marks[o.Email] = "fill:none;stroke:rgb(240,150,20);stroke-width:3"
+	}
+	for _, d := range inactive {
+		marks[d.Owners[0].Email] = "fill:none;stroke:rgb(220,40,40);stroke-width:3"
+	}
+	for _, tower := range field.Towers {
+		if style, exists := marks[tower.Email]; exists {
+			x, y := tower.Top()
+			canvas.Circle(x, y, 8, style)
+		}
+	}
+
+	users := make(map[string]*UserStat)
+	for _, u := range rs.Users {
+		users[u.Email] = u
+	}
+	var names []string
+	for _, o := range report.Repo.Owners {
+		names = append(names, userName(users[o.Email]))
+	}
+
+	y := TITLE_BLOCK_HEIGHT + CANVAS_PADDING
+	canvas.Text(CANVAS_PADDING, y, fmt.Sprintf("Bus factor %d: %s", len(report.Repo.Owners), strings.Join(names, ", ")), LABEL_STYLE)
+	for i, d := range inactive {
+		y += 18
+		if i == BUS_FACTOR_MAX_LISTED {
+			canvas.Text(CANVAS_PADDING, y, fmt.Sprintf("and %d more inactive directories", len(inactive)-i), LABEL_STYLE)
+			break
+		}
+		dirPath := d.Path
+		if dirPath == "" {
+			dirPath = "/"
+		}
+		canvas.Text(CANVAS_PADDING, y, fmt.Sprintf("%s: %s, inactive %d days", dirPath, userName(users[d.Owners[0].Email]), d.InactiveDays), LABEL_STYLE+";fill:rgb(200,40,40)")
+	}
+}
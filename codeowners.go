@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// places GitHub looks for CODEOWNERS, the first one found is used
+var CODEOWNERS_PATHS = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"}
+
+const CODEOWNERS_MAX_SIZE = 64 << 10
+
+// CodeOwnersRule is a CODEOWNERS line
+type CodeOwnersRule struct {
+	Pattern string   `json:"pattern"`
+	Owners  []string `json:"owners"`
+	Line    int      `json:"line,omitempty"` // in the existing file
+}
+
+// StaleOwner is an owner of the existing CODEOWNERS who no longer holds meaningful lines under the rule
+type StaleOwner struct {
+	Pattern string  `json:"pattern"`
+	Owner   string  `json:"owner"`
+	Line    int     `json:"line"`
+	Share   float64 `json:"share"`
+}
+
+// UnknownOwner is a login of the existing CODEOWNERS no contributor of the repo is resolved to.
+// Logins are resolved for the top contributors only, so its lines can't be told
+type UnknownOwner struct {
+	Pattern string `json:"pattern"`
+	Owner   string `json:"owner"`
+	Line    int    `json:"line"`
+}
+
+// readCodeOwners returns the path and the content of CODEOWNERS at rev, empty if the repo has none
+func readCodeOwners(repoPath, rev string, blobs map[string]string) (string, string, error) {
+	for _, p := range CODEOWNERS_PATHS {
+		if _, exists := blobs[p]; !exists {
+			continue
+		}
+		content, err := readBlobHead(repoPath, rev, p, CODEOWNERS_MAX_SIZE)
+		if err != nil {
+			return "", "", err
+		}
+		return p, string(content), nil
+	}
+	return "", "", nil
+}
+
+// ParseCodeOwners reads rules of a CODEOWNERS file, rules without owners included
+func ParseCodeOwners(content string) []CodeOwnersRule {
+	var rules []CodeOwnersRule
+	for i, line := range strings.Split(content, "\n") {
+		if c := strings.Index(line, "#"); c > -1 {
+			line = line[:c]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		rules = append(rules, CodeOwnersRule{Pattern: f[0], Owners: f[1:], Line: i + 1})
+	}
+	return rules
+}
+
+// codeOwnersSuggester walks the ownership tree and proposes a rule wherever the owners change
+type codeOwnersSuggester struct {
+	window   string
+	minShare float64
+	users    map[string]*UserStat
+	rules    []CodeOwnersRule
+}
+
+// owner returns the CODEOWNERS name of the user, the address if the login isn't known
+func (s *codeOwnersSuggester) owner(email string) string {
+	if u, exists := s.users[email]; exists && u.Username != "" {
+		return "@" + u.Username
+	}
+	return email
+}
+
+// owners of the directory holding at least minShare of its lines, nil if nobody does
+func (s *codeOwnersSuggester) owners(d *DirStat) []string {
+	total := d.Lines.Window(s.window)
+	if total == 0 {
+		return nil
+	}
+	var owners []string
+	// Users are sorted by total lines, the window may reorder them but owners are a set
+	for _, u := range d.Users {
+		if float64(u.Lines.Window(s.window))/float64(total) >= s.minShare {
+			owners = append(owners, s.owner(u.Email))
+		}
+	}
+	return owners
+}
+
+func sameOwners(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool)
+	for _, o := range a {
+		set[o] = true
+	}
+	for _, o := range b {
+		if !set[o] {
+			return false
+		}
+	}
+	return true
+}
+
+// walk adds rules of the directory and its subdirectories. Parents come first, since the last matching rule wins
+func (s *codeOwnersSuggester) walk(d *DirStat, dirPath string, inherited []string) {
+	owners := s.owners(d)
+	if owners == nil {
+		owners = inherited
+	} else if !sameOwners(owners, inherited) {
+		pattern := "*"
+		if dirPath != "" {
+			pattern = "/" + dirPath + "/"
+		}
+		s.rules = append(s.rules, CodeOwnersRule{Pattern: pattern, Owners: owners})
+	}
+
+	for _, child := range d.Children {
+		if !child.File {
+			s.walk(child, path.Join(dirPath, child.Name), owners)
+		}
+	}
+}
+
+// SuggestCodeOwners proposes a rule for every directory whose owners differ from the parent's.
+// Owners hold at least minShare of the directory lines in the window
+func SuggestCodeOwners(rs *RepoStat, window string, minShare float64) []CodeOwnersRule {
+	s := codeOwnersSuggester{window: window, minShare: minShare, users: make(map[string]*UserStat)}
+	for _, u := range rs.Users {
+		s.users[u.Email] = u
+	}
+	if rs.Tree != nil {
+		s.walk(rs.Tree, "", nil)
+	}
+	return s.rules
+}
+
+// FormatCodeOwners renders rules as a CODEOWNERS file
+func FormatCodeOwners(rules []CodeOwnersRule, header string) string {
+	b := bytes.Buffer{}
+	for _, line := range strings.Split(header, "\n") {
+		fmt.Fprintf(&b, "# %s\n", line)
+	}
+	for _, r := range rules {
+		fmt.Fprintf(&b, "%s %s\n", r.Pattern, strings.Join(r.Owners, " "))
+	}
+	return b.String()
+}
+
+// codeOwnersRegexp translates a CODEOWNERS pattern (gitignore syntax) to a regexp matching file paths.
+// A pattern matching a directory matches every file under it
+func codeOwnersRegexp(pattern string) (*regexp.Regexp, error) {
+	dirOnly := strings.HasSuffix(pattern, "/")
+	p := strings.Trim(pattern, "/")
+	// patterns without an inner slash match at any level
+	anchored := strings.HasPrefix(pattern, "/") || strings.Contains(p, "/")
+
+	re := bytes.Buffer{}
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(p); i++ {
+		switch {
+		case strings.HasPrefix(p[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case p[i] == '*':
+			re.WriteString("[^/]*")
+		case p[i] == '?':
+			re.WriteString("[^/]")
+		case p[i] == '[':
+			end := strings.Index(p[i:], "]")
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated [ in %q", pattern)
+			}
+			re.WriteString(p[i : i+end+1])
+			i += end
+		default:
+			re.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	switch {
+	case dirOnly:
+		re.WriteString("/.*$")
+	case strings.HasSuffix(p, "/*"):
+		// GitHub matches only the files directly in the directory
+		re.WriteString("$")
+	default:
+		re.WriteString("(/.*)?$")
+	}
+	return regexp.Compile(re.String())
+}
+
+// walkFiles calls fn with the path of every file under the node
+func (d *DirStat) walkFiles(dirPath string, fn func(filePath string, f *DirStat)) {
+	for _, child := range d.Children {
+		childPath := path.Join(dirPath, child.Name)
+		if child.File {
+			fn(childPath, child)
+		} else {
+			child.walkFiles(childPath, fn)
+		}
+	}
+}
+
+// ruleLines returns the lines of the files a rule applies to, in total and by user email.
+// ok is false if the rule matches no file of the tree
+func ruleLines(tree *DirStat, pattern, window string) (total int, byUser map[string]int, ok bool) {
+	byUser = make(map[string]int)
+	addNode := func(d *DirStat) {
+		total += d.Lines.Window(window)
+		for _, u := range d.Users {
+			byUser[u.Email] += u.Lines.Window(window)
+		}
+	}
+
+	p := strings.Trim(pattern, "/")
+	anchored := strings.HasPrefix(pattern, "/") || strings.Contains(p, "/")
+	switch {
+	case p == "*" || p == "**":
+		addNode(tree)
+		return total, byUser, true
+	case anchored && !strings.ContainsAny(p, "*?["):
+		// a plain path is found directly, it works on pruned trees too
+		d := tree.Find(p)
+		if d == nil || (strings.HasSuffix(pattern, "/") && d.File) {
+			return 0, nil, false
+		}
+		addNode(d)
+		return total, byUser, true
+	}
+
+	re, err := codeOwnersRegexp(pattern)
+	if err != nil {
+		return 0, nil, false
+	}
+	tree.walkFiles("", func(filePath string, f *DirStat) {
+		if re.MatchString(filePath) {
+			ok = true
+			addNode(f)
+		}
+	})
+	return total, byUser, ok
+}
+
+// StaleCodeOwners flags owners of the existing rules holding less than minShare of the lines of the files under the rule.
+// Logins which aren't resolved to a contributor are returned as unknown.
+// Teams can't be resolved to people, so they are never flagged. Rules matching no file are skipped
+func StaleCodeOwners(rs *RepoStat, existing []CodeOwnersRule, window string, minShare float64) (stale []StaleOwner, unknown []UnknownOwner) {
+	stale = []StaleOwner{}
+	unknown = []UnknownOwner{}
+	if rs.Tree == nil {
+		return
+	}
+
+	byOwner := make(map[string]string) // "@login" or address -> UserStat.Email
+	for _, u := range rs.Users {
+		if u.Username != "" {
+			byOwner["@"+strings.ToLower(u.Username)] = u.Email
+		}
+		byOwner[strings.ToLower(u.Email)] = u.Email
+		for _, e := range u.Emails {
+			byOwner[strings.ToLower(e)] = u.Email
+		}
+	}
+
+	for _, r := range existing {
+		total, byUser, ok := ruleLines(rs.Tree, r.Pattern, window)
+		if !ok {
+			continue
+		}
+		for _, owner := range r.Owners {
+			if strings.HasPrefix(owner, "@") && strings.Contains(owner, "/") {
+				continue
+			}
+			email, exists := byOwner[strings.ToLower(owner)]
+			if !exists && strings.HasPrefix(owner, "@") {
+				unknown = append(unknown, UnknownOwner{Pattern: r.Pattern, Owner: owner, Line: r.Line})
+				continue
+			}
+			share := 0.0
+			if total > 0 {
+				share = float64(byUser[email]) / float64(total)
+			}
+			if share < minShare {
+				stale = append(stale, StaleOwner{Pattern: r.Pattern, Owner: owner, Line: r.Line, Share: share})
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// CommentSyntax describes how comments and string literals look in a language
+type CommentSyntax struct {
+	Line       []string    // line comment markers, e.g. "//"
+	Block      [][2]string // block comment start and end markers, e.g. "/*", "*/"
+	Nested     bool        // block comments may be nested (OCaml, Haskell, Rust)
+	Strings    []string    // string delimiters with backslash escapes
+	RawStrings [][2]string // string start and end delimiters without escapes, may span lines
+	Docstrings []string    // string delimiters that are documentation when they start a line
+}
+
+var commentSyntaxByExt = make(map[string]*CommentSyntax)
+var commentSyntaxByName = make(map[string]*CommentSyntax)
+
+// RegisterCommentSyntax binds syntax to file extensions (".go") or exact file names ("Makefile")
+func RegisterCommentSyntax(syntax *CommentSyntax, names ...string) {
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
+			commentSyntaxByExt[strings.ToLower(name)] = syntax
+		} else {
+			commentSyntaxByName[name] = syntax
+		}
+	}
+}
+
+// CommentSyntaxFor returns the comment syntax for the file or nil if the language is unknown
+func CommentSyntaxFor(filePath string) *CommentSyntax {
+	if s, exists := commentSyntaxByName[path.Base(filePath)]; exists {
+		return s
+	}
+	return CommentSyntaxForExt(path.Ext(filePath))
+}
+
+// CommentSyntaxForExt returns the comment syntax registered for the extension (".go") or nil
+func CommentSyntaxForExt(ext string) *CommentSyntax {
+	return commentSyntaxByExt[strings.ToLower(ext)]
+}
+
+var (
+	cSyntax       = &CommentSyntax{Line: []string{"//"}, Block: [][2]string{{"/*", "*/"}}, Strings: []string{`"`, `'`}}
+	goSyntax      = &CommentSyntax{Line: []string{"//"}, Block: [][2]string{{"/*", "*/"}}, Strings: []string{`"`, `'`}, RawStrings: [][2]string{{"`", "`"}}}
+	jsSyntax      = &CommentSyntax{Line: []string{"//"}, Block: [][2]string{{"/*", "*/"}}, Strings: []string{`"`, `'`}, RawStrings: [][2]string{{"`", "`"}}}
+	rustSyntax    = &CommentSyntax{Line: []string{"//"}, Block: [][2]string{{"/*", "*/"}}, Nested: true, Strings: []string{`"`}}
+	phpSyntax     = &CommentSyntax{Line: []string{"//", "#"}, Block: [][2]string{{"/*", "*/"}}, Strings: []string{`"`, `'`}}
+	cssSyntax     = &CommentSyntax{Block: [][2]string{{"/*", "*/"}}, Strings: []string{`"`, `'`}}
+	pythonSyntax  = &CommentSyntax{Line: []string{"#"}, Strings: []string{`"`, `'`}, Docstrings: []string{`"""`, `'''`}}
+	hashSyntax    = &CommentSyntax{Line: []string{"#"}, Strings: []string{`"`, `'`}}
+	rubySyntax    = &CommentSyntax{Line: []string{"#"}, Block: [][2]string{{"=begin", "=end"}}, Strings: []string{`"`, `'`}}
+	sqlSyntax     = &CommentSyntax{Line: []string{"--"}, Block: [][2]string{{"/*", "*/"}}, Strings: []string{`'`, `"`}}
+	luaSyntax     = &CommentSyntax{Line: []string{"--"}, Block: [][2]string{{"--[[", "]]"}}, Strings: []string{`"`, `'`}, RawStrings: [][2]string{{"[[", "]]"}}}
+	haskellSyntax = &CommentSyntax{Line: []string{"--"}, Block: [][2]string{{"{-", "-}"}}, Nested: true, Strings: []string{`"`}}
+	markupSyntax  = &CommentSyntax{Block: [][2]string{{"<!--", "-->"}}}
+	lispSyntax    = &CommentSyntax{Line: []string{";"}, Block: [][2]string{{"#|", "|#"}}, Nested: true, Strings: []string{`"`}}
+	ocamlSyntax   = &CommentSyntax{Block: [][2]string{{"(*", "*)"}}, Nested: true, Strings: []string{`"`}}
+	fsharpSyntax  = &CommentSyntax{Line: []string{"//"}, Block: [][2]string{{"(*", "*)"}}, Nested: true, Strings: []string{`"`}}
+	percentSyntax = &CommentSyntax{Line: []string{"%"}, Strings: []string{`"`}}
+	iniSyntax     = &CommentSyntax{Line: []string{";", "#"}}
+)
+
+func init() {
+	RegisterCommentSyntax(cSyntax, ".c", ".h", ".cc", ".cpp", ".cxx", ".hpp", ".hh", ".hxx", ".m", ".mm", ".java", ".cs", ".swift", ".kt", ".kts", ".scala", ".dart", ".groovy", ".gradle", ".proto", ".d")
+	RegisterCommentSyntax(goSyntax, ".go")
+	RegisterCommentSyntax(jsSyntax, ".js", ".jsx", ".ts", ".tsx", ".mjs", ".cjs", ".es6")
+	RegisterCommentSyntax(rustSyntax, ".rs")
+	RegisterCommentSyntax(phpSyntax, ".php")
+	RegisterCommentSyntax(cssSyntax, ".css")
+	RegisterCommentSyntax(cSyntax, ".scss", ".less")
+	RegisterCommentSyntax(pythonSyntax, ".py", ".pyw", ".pyx")
+	RegisterCommentSyntax(hashSyntax, ".sh", ".bash", ".zsh", ".fish", ".pl", ".pm", ".yml", ".yaml", ".toml", ".r", ".cmake", ".ex", ".exs", ".nim", ".coffee", ".tcl", ".ps1", ".mk", ".conf", "Makefile", "makefile", "GNUmakefile", "Dockerfile", "CMakeLists.txt", "Vagrantfile")
+	RegisterCommentSyntax(rubySyntax, ".rb", ".rake", ".gemspec", "Rakefile", "Gemfile", "Podfile")
+	RegisterCommentSyntax(sqlSyntax, ".sql")
+	RegisterCommentSyntax(luaSyntax, ".lua")
+	RegisterCommentSyntax(haskellSyntax, ".hs", ".lhs", ".elm")
+	RegisterCommentSyntax(markupSyntax, ".html", ".htm", ".xml", ".xhtml", ".svg", ".xsl", ".xslt", ".plist", ".vue")
+	RegisterCommentSyntax(lispSyntax, ".lisp", ".lsp", ".el", ".clj", ".cljs", ".cljc", ".edn", ".scm", ".ss", ".rkt")
+	RegisterCommentSyntax(ocamlSyntax, ".ml", ".mli")
+	RegisterCommentSyntax(fsharpSyntax, ".fs", ".fsi", ".fsx")
+	RegisterCommentSyntax(percentSyntax, ".erl", ".hrl", ".tex", ".sty")
+	RegisterCommentSyntax(iniSyntax, ".ini", ".cfg", ".asm", ".s")
+}
+
+// CommentClassifier tells comment lines from code lines. It keeps state between lines
+// so it must be fed with every line of the file in order.
+type CommentClassifier struct {
+	syntax *CommentSyntax
+
+	blockDepth int    // depth of the currently open block comment
+	blockEnd   string // end marker of the currently open block comment
+	blockStart string // start marker of the currently open block comment, for nesting
+	rawEnd     string // end delimiter of the currently open multi-line string
+	rawIsDoc   bool   // currently open multi-line string is a docstring
+}
+
+func NewCommentClassifier(syntax *CommentSyntax) *CommentClassifier {
+	return &CommentClassifier{syntax: syntax}
+}
+
+// IsComment reports whether the line contains only comments (or docstrings).
+// Blank lines are comments only inside a block comment.
+func (c *CommentClassifier) IsComment(line string) bool {
+	if c.syntax == nil {
+		return false
+	}
+	hasCode := false
+	hasComment := false
+
+	i := 0
+	for i <= len(line) {
+		if c.blockDepth > 0 {
+			hasComment = true
+			i = c.skipBlock(line, i)
+			continue
+		}
+		if c.rawEnd != "" {
+			if c.rawIsDoc {
+				hasComment = true
+			} else {
+				hasCode = true
+			}
+			end := strings.Index(line[i:], c.rawEnd)
+			if end < 0 {
+				break
+			}
+			i += end + len(c.rawEnd)
+			c.rawEnd = ""
+			continue
+		}
+		if i == len(line) {
+			break
+		}
+
+		ch := line[i]
+		if ch == ' ' || ch == '\t' || ch == '\r' || ch == '\f' || ch == '\v' {
+			i++
+			continue
+		}
+		rest := line[i:]
+
+		if start, end, ok := matchPair(rest, c.syntax.Block); ok {
+			c.blockDepth = 1
+			c.blockStart, c.blockEnd = start, end
+			hasComment = true
+			i += len(start)
+			continue
+		}
+		if matchPrefix(rest, c.syntax.Line) != "" {
+			hasComment = true
+			break
+		}
+		if d := matchPrefix(rest, c.syntax.Docstrings); d != "" {
+			c.rawEnd, c.rawIsDoc = d, !hasCode
+			i += len(d)
+			continue
+		}
+		if start, end, ok := matchPair(rest, c.syntax.RawStrings); ok {
+			c.rawEnd, c.rawIsDoc = end, false
+			i += len(start)
+			continue
+		}
+		if d := matchPrefix(rest, c.syntax.Strings); d != "" {
+			hasCode = true
+			i = skipString(line, i+len(d), d)
+			continue
+		}
+
+		hasCode = true
+		i++
+	}
+
+	return hasComment && !hasCode
+}
+
+// skipBlock consumes the open block comment and returns the position after it (or the line length)
+func (c *CommentClassifier) skipBlock(line string, i int) int {
+	for i < len(line) {
+		if strings.HasPrefix(line[i:], c.blockEnd) {
+			i += len(c.blockEnd)
+			c.blockDepth--
+			if c.blockDepth == 0 {
+				return i
+			}
+			continue
+		}
+		if c.syntax.Nested && strings.HasPrefix(line[i:], c.blockStart) {
+			i += len(c.blockStart)
+			c.blockDepth++
+			continue
+		}
+		i++
+	}
+	return len(line) + 1
+}
+
+func matchPair(s string, pairs [][2]string) (start, end string, ok bool) {
+	for _, p := range pairs {
+		if strings.HasPrefix(s, p[0]) {
+			return p[0], p[1], true
+		}
+	}
+	return "", "", false
+}
+
+func matchPrefix(s string, prefixes []string) string {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// skipString returns the position after the closing delimiter or the line length if the string is not closed
+func skipString(line string, i int, delim string) int {
+	for i < len(line) {
+		if line[i] == '\\' {
+			i += 2
+			continue
+		}
+		if strings.HasPrefix(line[i:], delim) {
+			return i + len(delim)
+		}
+		i++
+	}
+	return len(line)
+}
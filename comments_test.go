@@ -0,0 +1,191 @@
+package main
+
+import "testing"
+
+type commentLine struct {
+	text    string
+	comment bool
+}
+
+var commentTests = []struct {
+	name  string
+	file  string
+	lines []commentLine
+}{
+	{"c line", "a.c", []commentLine{
+		{"// comment", true},
+		{"int x = 1; // trailing", false},
+		{"  \t// indented", true},
+	}},
+	{"c block", "a.java", []commentLine{
+		{"/* one line */", true},
+		{"/**", true},
+		{" * doc", true},
+		{"", true},
+		{" */", true},
+		{"/* a */ /* b */", true},
+		{"/* a */ int x;", false},
+		{"", false},
+	}},
+	{"c block not nested", "a.cpp", []commentLine{
+		{"/* a /* b */", true},
+		{"int x; */", false},
+	}},
+	{"c strings", "a.c", []commentLine{
+		{`char *s = "// not a comment";`, false},
+		{`char *s = "/* not a comment";`, false},
+		{"int y;", false},
+		{`char c = '"'; // quote`, false},
+		{`s = "escaped \" // still string";`, false},
+	}},
+	{"c unterminated block", "a.h", []commentLine{
+		{"/* never closed", true},
+		{"int x;", true},
+		{"", true},
+	}},
+	{"c unterminated string", "a.c", []commentLine{
+		{`s = "open // text`, false},
+		{"// next line is fresh", true},
+	}},
+	{"go raw string", "a.go", []commentLine{
+		{"s := `", false},
+		{"// inside raw string", false},
+		{"/* also inside", false},
+		{"`", false},
+		{"// comment", true},
+	}},
+	{"js template", "a.ts", []commentLine{
+		{"const s = `/* not", false},
+		{"a comment */`", false},
+		{"/* real */", true},
+		{`const u = "http://example.com"`, false},
+	}},
+	{"rust nested", "a.rs", []commentLine{
+		{"/* a /* b */", true},
+		{"still comment */", true},
+		{"fn main() {}", false},
+		{`let s = "/*";`, false},
+		{"// after string", true},
+	}},
+	{"php", "a.php", []commentLine{
+		{"# hash", true},
+		{"// slashes", true},
+		{"/* block */", true},
+		{`$s = '# not a comment';`, false},
+	}},
+	{"css", "a.css", []commentLine{
+		{"/* rule */", true},
+		{"// not a css comment", false},
+		{`a { content: "/*"; }`, false},
+		{"b {}", false},
+	}},
+	{"python", "a.py", []commentLine{
+		{"# comment", true},
+		{`"""Docstring`, true},
+		{"more doc # text", true},
+		{`"""`, true},
+		{`x = """value`, false},
+		{"# inside string", false},
+		{`"""`, false},
+		{`'''one line'''`, true},
+		{`print("#")`, false},
+	}},
+	{"shell", "build.sh", []commentLine{
+		{"#!/bin/sh", true},
+		{`echo "# not a comment"`, false},
+		{"echo x # trailing", false},
+	}},
+	{"makefile", "Makefile", []commentLine{
+		{"# target", true},
+		{"all:", false},
+	}},
+	{"ruby", "a.rb", []commentLine{
+		{"# comment", true},
+		{"=begin", true},
+		{"puts 1", true},
+		{"=end", true},
+		{`puts "# text"`, false},
+	}},
+	{"sql", "a.sql", []commentLine{
+		{"-- comment", true},
+		{"select '--' from t", false},
+		{"/* block", true},
+		{"*/", true},
+	}},
+	{"lua", "a.lua", []commentLine{
+		{"--[[", true},
+		{"x = 1", true},
+		{"]]", true},
+		{"-- line", true},
+		{"s = [[", false},
+		{"-- inside long string", false},
+		{"]]", false},
+	}},
+	{"haskell nested", "a.hs", []commentLine{
+		{"{- a {- b -} c", true},
+		{"-}", true},
+		{"main = 1 -- x", false},
+		{"-- line", true},
+		{`s = "{-"`, false},
+	}},
+	{"markup", "a.html", []commentLine{
+		{"<!-- a", true},
+		{"b -->", true},
+		{"<p>", false},
+		{"<!-- a --> <p>", false},
+	}},
+	{"lisp", "a.clj", []commentLine{
+		{"; comment", true},
+		{"#| block #| nested |#", true},
+		{"|#", true},
+		{`(str ";")`, false},
+	}},
+	{"ocaml nested", "a.ml", []commentLine{
+		{"(* a (* b *)", true},
+		{"still *)", true},
+		{"let x = 1", false},
+		{`let s = "(*"`, false},
+		{"(* unterminated", true},
+	}},
+	{"fsharp", "a.fs", []commentLine{
+		{"// line", true},
+		{"(* block *)", true},
+		{"let x = 1", false},
+	}},
+	{"percent", "a.erl", []commentLine{
+		{"% comment", true},
+		{`io:format("%s")`, false},
+	}},
+	{"ini", "a.ini", []commentLine{
+		{"; comment", true},
+		{"# comment", true},
+		{"key=value", false},
+	}},
+	{"unknown language", "a.unknown", []commentLine{
+		{"// looks like a comment", false},
+		{"# too", false},
+	}},
+}
+
+func TestCommentClassifier(t *testing.T) {
+	for _, tt := range commentTests {
+		c := NewCommentClassifier(CommentSyntaxFor(tt.file))
+		for i, l := range tt.lines {
+			if got := c.IsComment(l.text); got != l.comment {
+				t.Errorf("%s: line %d %q: got %v, want %v", tt.name, i+1, l.text, got, l.comment)
+			}
+		}
+	}
+}
+
+func TestCommentTestsCoverSyntaxes(t *testing.T) {
+	covered := make(map[*CommentSyntax]bool)
+	for _, tt := range commentTests {
+		covered[CommentSyntaxFor(tt.file)] = true
+	}
+	for ext, s := range commentSyntaxByExt {
+		if !covered[s] {
+			t.Errorf("no comment test for the syntax of %s", ext)
+		}
+	}
+}
@@ -26,9 +26,105 @@
 
     $('#visbut').bind('click', function(event) {
     clearTimeout(visGetRepo);
+    stopProgress();
+    $("#asof-text").hide();
            getRepo();
         });
         var visGetRepo;
+        var progressSource;
+
+        var phases = {"queued": "Waiting in queue", "cloning": "Cloning repository", "blaming": "Calculating", "resolving identities": "Resolving contributors"};
+
+        function formatETA(seconds){
+            if (seconds < 60) {
+                return seconds + "s";
+            }
+            return Math.round(seconds / 60) + "m";
+        }
+
+        function showProgress(p){
+            var text = phases[p.State] || "Cloning repository and calculating";
+            if (p.TotalFiles > 0) {
+                text += ": " + p.Files + " / " + p.TotalFiles + " files";
+                $("#progress").val(Math.floor(100 * p.Files / p.TotalFiles));
+            }
+            if (p.ETA > 0) {
+                text += ", about " + formatETA(p.ETA) + " left";
+            }
+            if (p.Error && p.Attempts > 0) {
+                text += " (retry " + p.Attempts + " after error: " + p.Error + ")";
+            }
+            $("#progress-text").text(text);
+        }
+
+        function showFailure(error){
+            $("#vis").show();
+            $("#vis .loading").show();
+            $("#vis .sk-folding-cube").hide();
+            $("#progress").hide();
+            $("#progress-text").text("Failed: " + error);
+        }
+
+        function stopProgress(){
+            if (progressSource) {
+                progressSource.close();
+                progressSource = undefined;
+            }
+        }
+
+        // progress is pushed by the server, polling is only used without EventSource
+        function watchProgress(){
+            if (progressSource) {
+                return;
+            }
+            $("#progress").val(0);
+            progressSource = new EventSource("/progress?" + $.param({ repo: $("#repo").val(), ref: $("#ref").val(), asof: $("#asof").val() }));
+            progressSource.addEventListener("progress", function(e) {
+                showProgress(JSON.parse(e.data));
+            });
+            progressSource.addEventListener("ready", function(e) {
+                stopProgress();
+                getRepo();
+            });
+            progressSource.addEventListener("failed", function(e) {
+                stopProgress();
+                showFailure(JSON.parse(e.data).Error);
+            });
+            progressSource.onerror = function() {
+                stopProgress();
+                visGetRepo=setTimeout(getRepo,1000);
+            };
+        }
+
+        // the analyzed commit, so a ref or as-of date is never mistaken for HEAD
+        function showAsOf(stat){
+            if (!stat.Commit) {
+                $("#asof-text").hide();
+                return;
+            }
+            var text = "Commit " + stat.Commit.substring(0, 10);
+            var date = new Date(stat.CommitTime);
+            if (stat.CommitTime && date.getFullYear() > 1) {
+                text += " of " + date.toISOString().substring(0, 10);
+            }
+            if ($("#asof").val()) {
+                text += ", the last one before " + $("#asof").val();
+            }
+            $("#asof-text").text(text).show();
+        }
+
+        // the saved image has all lines, windows move with the current date so they are drawn on request
+        function svgURL(hash){
+            var w = $("#window").val();
+            if (!w || w == "Total") {
+                return "/static/svgs/"+hash+".svg";
+            }
+            return "/draw?" + $.param({ repo: $("#repo").val(), ref: $("#ref").val(), asof: $("#asof").val(), window: w });
+        }
+
+        $('#window').bind('change', function(event) {
+            getRepo();
+        });
 
         function attachSVG(){
         $('svg g').bind('mousein mouseover', function(event) {
@@ -49,15 +145,25 @@ function getRepo(){
         method: "POST",
         dataType: "json",
         url: "/check",
-       data: { name: $("#owner").val(), repo:  $("#repo").val() }
+       data: { name: $("#owner").val(), repo:  $("#repo").val(), ref: $("#ref").val(), asof: $("#asof").val() }
     }) .done(function( data ) {
 
-         if(data.status=="processing"){
-           visGetRepo=setTimeout(getRepo,1000);
+         if(data.status=="failed"){
+            stopProgress();
+            showFailure(data.error);
+         }else if(data.status=="processing"){
+            $("#vis .sk-folding-cube").show();
+            $("#progress").show();
+           if (window.EventSource) {
+               watchProgress();
+           } else {
+               visGetRepo=setTimeout(getRepo,1000);
+           }
             $("#vis").show();
             $("#vis .loading").show();
          }else  if(data.status=="ready"){
          window.rs=data.stat;
+           showAsOf(data.stat);
            $("#vis #svg").show();
             $("#vis").show();
             $("#vis .loading").hide();
@@ -65,7 +171,7 @@ function getRepo(){
 $.ajax({
         method: "GET",
         dataType: "text",
-        url: "/static/svgs/"+data.hash+".svg",
+        url: svgURL(data.hash),
     })  .done(function( data ) {
      $("#svg").html("");
       $("#svg").append(data);
@@ -77,7 +183,13 @@ setTimeout(attachSVG,1000);
 
 
 
-}})
+}}).fail(function( xhr ) {
+    // a bad repo name is rejected with 400
+    if (xhr.responseJSON && xhr.responseJSON.status=="failed") {
+        stopProgress();
+        showFailure(xhr.responseJSON.error);
+    }
+})
 }
 
 }(jQuery));
\ No newline at end of file
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var GENERATED_REGEXPS = []string{`\.pb\.(go|cc|h|c)$`, `\.pb\.gw\.go$`, `_pb2(_grpc)?\.py$`, `\.pb\.swift$`, `(^|/)bindata\.go$`, `(^|/)mock_[^/]*\.go$`, `_mock\.go$`, `(^|/)zz_generated[^/]*\.go$`, `\.designer\.cs$`, `(^|/)package-lock\.json$`, `(^|/)npm-shrinkwrap\.json$`, `(^|/)yarn\.lock$`, `(^|/)pnpm-lock\.yaml$`, `(^|/)go\.sum$`, `(^|/)Gopkg\.lock$`, `(^|/)glide\.lock$`, `(^|/)Godeps/Godeps\.json$`, `(^|/)Gemfile\.lock$`, `(^|/)Cargo\.lock$`, `(^|/)composer\.lock$`, `(^|/)Pipfile\.lock$`, `(^|/)poetry\.lock$`, `(^|/)Podfile\.lock$`, `(^|/)mix\.lock$`}
+
+// markers are searched only in comment lines, so sources that merely mention them stay hand-written
+var GENERATED_MARKERS = []string{`.*DO NOT EDIT`, `@generated`, `.*(?i:generated by the protocol buffer compiler)`, `.*(?i:\bauto-?generated\b)`, `.*(?i:this (file|code) (is|was|has been) (automatically |auto-)?generated)`}
+
+const GENERATED_COMMENT_PREFIX = `(?m)^\s*(?://|#|/?\*+|--|;+|<!--|%|"""|''')\s*`
+
+// how much of the file head is searched for generated markers
+const GENERATED_HEAD_SIZE = 1024
+
+var generatedRegexp *regexp.Regexp
+var generatedMarkerRegexp *regexp.Regexp
+
+// skipGenerated drops generated files instead of counting them as Generated lines
+var skipGenerated bool
+
+func init() {
+	generatedRegexp = regexp.MustCompile(strings.Join(GENERATED_REGEXPS, "|"))
+	generatedMarkerRegexp = regexp.MustCompile(GENERATED_COMMENT_PREFIX + "(?:" + strings.Join(GENERATED_MARKERS, "|") + ")")
+}
+
+// isGeneratedFile detects generated files by well-known names and markers in the head of the file
+func isGeneratedFile(filePath string, head []byte) bool {
+	if generatedRegexp.MatchString(filePath) {
+		return true
+	}
+	if len(head) > GENERATED_HEAD_SIZE {
+		head = head[:GENERATED_HEAD_SIZE]
+	}
+	return generatedMarkerRegexp.Match(head)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// longest sleep waiting for a rate limit reset, after that identities stay email-only
+const GITHUB_MAX_RATE_WAIT = time.Minute
+
+var errNoGithubToken = errors.New("No GitHub token configured")
+var errGithubRateLimited = errors.New("All GitHub tokens are rate limited")
+
+type githubToken struct {
+	token     string
+	remaining int // -1 until the first response
+	reset     time.Time
+}
+
+// GithubClient shares GitHub tokens between requests and rotates them by X-RateLimit-Remaining
+type GithubClient struct {
+	mu     sync.Mutex
+	tokens []*githubToken
+	next   int
+}
+
+// githubTokensEnv returns the comma-separated tokens of GFGITHUB_TOKENS or of GFGITHUB_TOKEN, its older name
+func githubTokensEnv() string {
+	if tokens := os.Getenv("GFGITHUB_TOKENS"); tokens != "" {
+		return tokens
+	}
+	return os.Getenv("GFGITHUB_TOKEN")
+}
+
+func NewGithubClient(tokens []string) *GithubClient {
+	c := &GithubClient{}
+	c.SetTokens(tokens)
+	return c
+}
+
+func (c *GithubClient) SetTokens(tokens []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens = nil
+	for _, t := range tokens {
+		if t = strings.TrimSpace(t); t != "" {
+			c.tokens = append(c.tokens, &githubToken{token: t, remaining: -1})
+		}
+	}
+	c.next = 0
+}
+
+// Tokens returns the number of configured tokens
+func (c *GithubClient) Tokens() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.tokens)
+}
+
+// pick returns a token with requests left, waiting for the reset if it is close enough
+func (c *GithubClient) pick() (*githubToken, error) {
+	c.mu.Lock()
+	if len(c.tokens) == 0 {
+		c.mu.Unlock()
+		return nil, errNoGithubToken
+	}
+
+	now := time.Now()
+	var soonest *githubToken
+	for i := range c.tokens {
+		t := c.tokens[(c.next+i)%len(c.tokens)]
+		if t.remaining != 0 || now.After(t.reset) {
+			c.next = (c.next + i + 1) % len(c.tokens)
+			c.mu.Unlock()
+			return t, nil
+		}
+		if soonest == nil || t.reset.Before(soonest.reset) {
+			soonest = t
+		}
+	}
+	c.mu.Unlock()
+
+	wait := soonest.reset.Sub(now)
+	if wait > GITHUB_MAX_RATE_WAIT {
+		return nil, errGithubRateLimited
+	}
+	log.WithField("wait", wait).Warn("GitHub rate limit exhausted, waiting for reset")
+	time.Sleep(wait)
+	return soonest, nil
+}
+
+// isRateLimited reports whether the request failed because the token run out of requests
+func isRateLimited(resp *http.Response) bool {
+	return resp != nil && (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests) && resp.Header.Get("X-RateLimit-Remaining") == "0"
+}
+
+// update remembers the rate limit state reported by GitHub
+func (c *GithubClient) update(t *githubToken, header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, _ := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.remaining = remaining
+	t.reset = time.Unix(reset, 0)
+}
+
+// HTTPClient returns a client authenticated with the next available token
+func (c *GithubClient) HTTPClient() (*http.Client, error) {
+	t, err := c.pick()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Timeout: apiClient.Timeout, Transport: &githubTransport{client: c, token: t}}, nil
+}
+
+type githubTransport struct {
+	client *GithubClient
+	token  *githubToken
+}
+
+func (t *githubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTripper must not modify the request
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "token "+t.token.token)
+
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	t.client.update(t.token, resp.Header)
+	return resp, nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/go-github/github"
+)
+
+// server-side aliases, commit address -> canonical address
+var serverAliases = make(map[string]string)
+
+var noreplyRegexp = regexp.MustCompile(`^(?:[0-9]+\+)?([^@+]+)@users\.noreply\.github\.com$`)
+
+var mailmapEmailRegexp = regexp.MustCompile(`<([^>]*)>`)
+
+// LoadAliases reads the server-side alias file. It has .mailmap format:
+// "Proper Name <proper@email> Commit Name <commit@email>" or "<proper@email> <commit@email>"
+func LoadAliases(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i > -1 {
+			line = line[:i]
+		}
+		emails := mailmapEmailRegexp.FindAllStringSubmatch(line, -1)
+		if len(emails) < 2 {
+			// name-only mappings don't merge identities
+			continue
+		}
+		serverAliases[strings.ToLower(emails[1][1])] = strings.ToLower(emails[0][1])
+	}
+	return nil
+}
+
+// noreplyLogin returns the GitHub login from a noreply address or an empty string
+func noreplyLogin(email string) string {
+	m := noreplyRegexp.FindStringSubmatch(strings.ToLower(email))
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// CanonicalEmail returns the address the commit address is merged into
+func CanonicalEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if canonical, exists := serverAliases[email]; exists {
+		email = canonical
+	}
+	// 12345+login@users.noreply.github.com and login@users.noreply.github.com are the same account
+	if login := noreplyLogin(email); login != "" {
+		return login + "@users.noreply.github.com"
+	}
+	return email
+}
+
+// IdentityResolver finds the account of a commit author on the repo host
+type IdentityResolver interface {
+	Username(owner, repo, commitID string) (string, error)
+}
+
+// GithubResolver resolves logins on github.com or GitHub Enterprise
+type GithubResolver struct {
+	BaseURL string // API root, e.g. https://api.github.com/
+	Client  *GithubClient
+}
+
+func (r *GithubResolver) Username(owner, repo, commitID string) (string, error) {
+	// a rate limited token is rotated out, so try every token once
+	attempts := r.Client.Tokens()
+	for i := 0; ; i++ {
+		tc, err := r.Client.HTTPClient()
+		if err == errNoGithubToken {
+			// without a token identities stay email-only
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		client := github.NewClient(tc)
+		if r.BaseURL != "" {
+			baseURL, err := url.Parse(strings.TrimSuffix(r.BaseURL, "/") + "/")
+			if err != nil {
+				return "", err
+			}
+			client.BaseURL = baseURL
+		}
+
+		commit, resp, err := client.Repositories.GetCommit(owner, repo, commitID)
+
+		if err != nil {
+			if resp != nil && isRateLimited(resp.Response) && i+1 < attempts {
+				continue
+			}
+			if resp != nil && resp.Response != nil && resp.StatusCode >= 500 {
+				return "", &apiStatusError{Method: "GET", Path: resp.Request.URL.Path, Status: resp.Status, Code: resp.StatusCode}
+			}
+			return "", err
+		}
+
+		if commit == nil || commit.Author == nil || commit.Author.Login == nil {
+			return "", nil
+		}
+		return *commit.Author.Login, nil
+	}
+}
+
+// GitlabResolver resolves usernames on gitlab.com or a self-hosted GitLab
+type GitlabResolver struct {
+	BaseURL string // instance root, e.g. https://gitlab.com
+	Token   string
+}
+
+func (r *GitlabResolver) get(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(r.BaseURL, "/")+"/api/v4/"+path, nil)
+	if err != nil {
+		return err
+	}
+	if r.Token != "" {
+		req.Header.Set("PRIVATE-TOKEN", r.Token)
+	}
+	return getJSON(req, v)
+}
+
+func (r *GitlabResolver) Username(owner, repo, commitID string) (string, error) {
+	// GitLab commits don't link to accounts, so the author is searched by email
+	commit := struct {
+		AuthorEmail string `json:"author_email"`
+	}{}
+	err := r.get("projects/"+url.PathEscape(owner+"/"+repo)+"/repository/commits/"+url.PathEscape(commitID), &commit)
+	if err != nil {
+		return "", err
+	}
+	if commit.AuthorEmail == "" {
+		return "", nil
+	}
+
+	var users []struct {
+		Username string `json:"username"`
+	}
+	err = r.get("users?search="+url.QueryEscape(commit.AuthorEmail), &users)
+	if err != nil {
+		return "", err
+	}
+	if len(users) != 1 {
+		return "", nil
+	}
+	return users[0].Username, nil
+}
+
+// GiteaResolver resolves logins on Gitea and Gitea-based hosts like Codeberg
+type GiteaResolver struct {
+	BaseURL string // instance root, e.g. https://gitea.com
+	Token   string
+}
+
+func (r *GiteaResolver) Username(owner, repo, commitID string) (string, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(r.BaseURL, "/")+"/api/v1/repos/"+url.PathEscape(owner)+"/"+url.PathEscape(repo)+"/git/commits/"+url.PathEscape(commitID), nil)
+	if err != nil {
+		return "", err
+	}
+	if r.Token != "" {
+		req.Header.Set("Authorization", "token "+r.Token)
+	}
+
+	commit := struct {
+		Author *struct {
+			Login string `json:"login"`
+		} `json:"author"`
+	}{}
+	if err = getJSON(req, &commit); err != nil {
+		return "", err
+	}
+	if commit.Author == nil {
+		return "", nil
+	}
+	return commit.Author.Login, nil
+}
+
+var apiClient = &http.Client{Timeout: 30 * time.Second}
+
+func getJSON(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &apiStatusError{Method: req.Method, Path: req.URL.Path, Status: resp.Status, Code: resp.StatusCode}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+var resolversMu sync.RWMutex
+
+// shared by all github.com lookups, tokens are set from -github-tokens
+var githubClient = NewGithubClient(nil)
+
+var resolvers = map[string]IdentityResolver{
+	"github.com":   &GithubResolver{Client: githubClient},
+	"gitlab.com":   &GitlabResolver{BaseURL: "https://gitlab.com"},
+	"gitea.com":    &GiteaResolver{BaseURL: "https://gitea.com"},
+	"codeberg.org": &GiteaResolver{BaseURL: "https://codeberg.org"},
+}
+
+// RegisterResolver sets the identity resolver used for repos on the host
+func RegisterResolver(host string, r IdentityResolver) {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+	resolvers[strings.ToLower(host)] = r
+}
+
+// ResolverForHost returns the identity resolver of the host or nil if accounts can't be resolved there
+func ResolverForHost(host string) IdentityResolver {
+	resolversMu.RLock()
+	defer resolversMu.RUnlock()
+	return resolvers[strings.ToLower(host)]
+}
+
+// ConfigureHosts registers self-hosted servers from a "host=kind,..." list where kind is github, gitlab or gitea.
+// Tokens are taken from GFGITHUB_TOKENS (or GFGITHUB_TOKEN), GFGITLAB_TOKEN and GFGITEA_TOKEN
+func ConfigureHosts(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return errors.New("Bad host definition: " + item)
+		}
+		host, kind := kv[0], strings.ToLower(kv[1])
+
+		switch kind {
+		case "github":
+			RegisterResolver(host, &GithubResolver{BaseURL: "https://" + host + "/api/v3/", Client: NewGithubClient(strings.Split(githubTokensEnv(), ","))})
+		case "gitlab":
+			RegisterResolver(host, &GitlabResolver{BaseURL: "https://" + host, Token: os.Getenv("GFGITLAB_TOKEN")})
+		case "gitea":
+			RegisterResolver(host, &GiteaResolver{BaseURL: "https://" + host, Token: os.Getenv("GFGITEA_TOKEN")})
+		default:
+			return errors.New("Unknown host kind: " + kind)
+		}
+	}
+	return nil
+}
+
+// ResolveUsername returns the account login of the commit author or an empty string.
+// Logins are cached by author email and by commit. Errors are logged, they are returned to retry the job on server errors
+func ResolveUsername(host, owner, repo, commitID, email string) (string, error) {
+	r := ResolverForHost(host)
+	if r == nil {
+		return "", nil
+	}
+
+	emailKey := host + "/email/" + email
+	commitKey := host + "/commit/" + commitID
+	if login, exists := logins.Get(emailKey); exists {
+		return login, nil
+	}
+	if login, exists := logins.Get(commitKey); exists {
+		return login, nil
+	}
+
+	login, err := r.Username(owner, repo, commitID)
+
+	if err != nil {
+		log.WithError(err).WithField("host", host).WithField("commit", commitID).Error("Can't resolve username")
+		return "", err
+	}
+	if login != "" {
+		logins.Set(emailKey, login)
+		logins.Set(commitKey, login)
+	}
+	return login, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolvers(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/api/v3/repos/owner/repo/commits/abc":
+			auth = r.Header.Get("Authorization")
+			w.Write([]byte(`{"author":{"login":"ghuser"}}`))
+		case "/api/v4/projects/group%2Fsub%2Frepo/repository/commits/abc":
+			auth = r.Header.Get("PRIVATE-TOKEN")
+			w.Write([]byte(`{"author_email":"dev@example.com"}`))
+		case "/api/v4/users":
+			if r.URL.Query().Get("search") != "dev@example.com" {
+				w.Write([]byte(`[]`))
+				return
+			}
+			w.Write([]byte(`[{"username":"gluser"}]`))
+		case "/api/v1/repos/owner/repo/git/commits/abc":
+			auth = r.Header.Get("Authorization")
+			w.Write([]byte(`{"author":{"login":"gtuser"}}`))
+		case "/api/v1/repos/owner/repo/git/commits/nologin":
+			w.Write([]byte(`{"author":null}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		resolver IdentityResolver
+		owner    string
+		commit   string
+		login    string
+		auth     string
+	}{
+		{"github", &GithubResolver{BaseURL: srv.URL + "/api/v3/", Client: NewGithubClient([]string{"ghtoken"})}, "owner", "abc", "ghuser", "token ghtoken"},
+		{"gitlab subgroup", &GitlabResolver{BaseURL: srv.URL, Token: "gltoken"}, "group/sub", "abc", "gluser", "gltoken"},
+		{"gitea", &GiteaResolver{BaseURL: srv.URL + "/", Token: "gttoken"}, "owner", "abc", "gtuser", "token gttoken"},
+		{"gitea without account", &GiteaResolver{BaseURL: srv.URL}, "owner", "nologin", "", ""},
+	}
+	for _, tt := range tests {
+		auth = ""
+		login, err := tt.resolver.Username(tt.owner, "repo", tt.commit)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if login != tt.login {
+			t.Errorf("%s: got login %q, want %q", tt.name, login, tt.login)
+		}
+		if auth != tt.auth {
+			t.Errorf("%s: got auth %q, want %q", tt.name, auth, tt.auth)
+		}
+	}
+}
+
+func TestResolverErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	for _, r := range []IdentityResolver{&GitlabResolver{BaseURL: srv.URL}, &GiteaResolver{BaseURL: srv.URL}} {
+		_, err := r.Username("owner", "repo", "abc")
+		se, ok := err.(*apiStatusError)
+		if !ok || se.Code != http.StatusBadGateway {
+			t.Errorf("%T: got %v, want a 502 apiStatusError", r, err)
+		}
+	}
+}
+
+func TestGithubResolverWithoutTokens(t *testing.T) {
+	r := &GithubResolver{BaseURL: "http://127.0.0.1:1/", Client: NewGithubClient(nil)}
+	login, err := r.Username("owner", "repo", "abc")
+	if login != "" || err != nil {
+		t.Errorf("got %q, %v, want no login and no error", login, err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// bump it when BlameFile starts to classify lines differently or FileStat gains fields, so old caches are dropped
+const BLAME_CACHE_VERSION = 4
+
+// the cache lives inside the mirror's .git dir, so it goes away together with the mirror
+const BLAME_CACHE_FILE = "gitfluence-blame.json"
+
+// BlameCache keeps per-file blame results of the last analyzed commit
+type BlameCache struct {
+	Version int
+	Commit  string
+	Files   map[string]*CachedFileStat
+}
+
+// CachedFileStat is the blame result of the file at the blob SHA. Stat is nil for empty files
+type CachedFileStat struct {
+	Blob string
+	Stat *FileStat
+}
+
+func blameCachePath(repoPath string) string {
+	return filepath.Join(repoPath, ".git", BLAME_CACHE_FILE)
+}
+
+// loadBlameCache returns the cache stored for the mirror or nil if there is no usable one
+func loadBlameCache(repoPath string) *BlameCache {
+	f, err := os.Open(blameCachePath(repoPath))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	cache := BlameCache{}
+	if err = json.NewDecoder(f).Decode(&cache); err != nil || cache.Version != BLAME_CACHE_VERSION || cache.Files == nil {
+		return nil
+	}
+	return &cache
+}
+
+func (c *BlameCache) Save(repoPath string) error {
+	tmp := blameCachePath(repoPath) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(f).Encode(c); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, blameCachePath(repoPath))
+}
+
+// Lookup returns the cached stat if the file was not touched since the cached commit
+func (c *BlameCache) Lookup(file, blob string, changed map[string]bool) (*CachedFileStat, bool) {
+	if c == nil || changed[file] {
+		return nil, false
+	}
+	cached, exists := c.Files[file]
+	if !exists || cached.Blob != blob {
+		return nil, false
+	}
+	return cached, true
+}
+
+// RemoteHead returns the SHA the remote HEAD points to without fetching anything
+func RemoteHead(repoURL string) (string, error) {
+	if err := checkRepoURL(repoURL); err != nil {
+		return "", err
+	}
+	cmd := gitRemoteCommand(context.Background(), "ls-remote", "--", repoURL, "HEAD")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	f := strings.Fields(string(out))
+	if len(f) == 0 {
+		return "", errors.New("git ls-remote: no HEAD in " + repoURL)
+	}
+	return f[0], nil
+}
+
+// RepoListBlobs returns blob SHAs of all files at rev keyed by path
+func RepoListBlobs(repoPath string, rev string) (map[string]string, error) {
+	cmd := exec.Command("git", "ls-tree", "-z", "-r", rev)
+	cmd.Dir = repoPath
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make(map[string]string)
+	// <mode> SP <type> SP <object> TAB <file> NUL
+	for _, entry := range bytes.Split(out, []byte{0}) {
+		tab := bytes.IndexByte(entry, '\t')
+		if tab < 0 {
+			continue
+		}
+		f := strings.Fields(string(entry[:tab]))
+		if len(f) != 3 || f[1] != "blob" {
+			// submodules are listed as commits
+			continue
+		}
+		blobs[string(entry[tab+1:])] = f[2]
+	}
+	return blobs, nil
+}
+
+// RepoChangedFiles lists files touched between two commits
+func RepoChangedFiles(repoPath, from, to string) (map[string]bool, error) {
+	cmd := exec.Command("git", "diff", "--name-only", "-z", "--no-renames", from, to)
+	cmd.Dir = repoPath
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make(map[string]bool)
+	for _, file := range strings.Split(string(out), "\x00") {
+		if file != "" {
+			changed[file] = true
+		}
+	}
+	return changed, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobCloning   JobState = "cloning"
+	JobBlaming   JobState = "blaming"
+	JobResolving JobState = "resolving identities"
+	JobDone      JobState = "done"
+	JobFailed    JobState = "failed"
+)
+
+// states of a job held by a worker under a lease
+var activeJobStates = []JobState{JobCloning, JobBlaming, JobResolving}
+
+// a job whose lease was not renewed for that long is taken by another worker
+const JOB_LEASE = 2 * time.Minute
+
+var errLeaseLost = errors.New("Job lease lost")
+
+// the reason of jobs whose lease expired in every attempt, the worker likely crashes on the repo
+var errJobAbandoned = errors.New("Analysis was interrupted in every attempt")
+
+// Job is a repo analysis request. The result is kept on the job, so it survives worker restarts
+type Job struct {
+	Hash       string `bson:"_id"`
+	Config     RepoConfig
+	State      JobState
+	Error      string `bson:",omitempty"` // reason of the failure or of the last retry
+	Attempts   int
+	RetryAt    time.Time // queued jobs are not claimed before that
+	Refresh    bool
+	Worker     string    `bson:",omitempty"` // worker node the job was queued on, it holds the mirror
+	LeaseOwner string    `bson:",omitempty"`
+	LeaseUntil time.Time `bson:",omitempty"`
+	Created    time.Time
+	Updated    time.Time
+	Result     *Repo `bson:",omitempty"`
+}
+
+func (j *Job) isActive() bool {
+	for _, s := range activeJobStates {
+		if j.State == s {
+			return true
+		}
+	}
+	return false
+}
+
+// JobStore keeps jobs with their states and results
+type JobStore interface {
+	// Enqueue queues the analysis on the worker node unless it's already queued, running or done.
+	// Done jobs are queued again when refresh is set
+	Enqueue(rc RepoConfig, refresh bool, node string) (*Job, error)
+	// Claim leases the oldest job queued on the node or a job whose lease expired. It returns nil if there are none.
+	// Jobs whose lease expired after JOB_MAX_ATTEMPTS attempts fail instead
+	Claim(owner, node string) (*Job, error)
+	// Renew extends the lease of the job held by the owner
+	Renew(hash, owner string) error
+	SetState(hash, owner string, state JobState) error
+	Finish(hash, owner string, result *Repo) error
+	Fail(hash, owner string, reason error) error
+	// Retry queues the job again after a temporary failure
+	Retry(hash, owner string, reason error, at time.Time) error
+	// Cancel fails the job if it's still queued
+	Cancel(hash string, reason error) (bool, error)
+	Get(hashes []string) ([]*Job, error)
+}
+
+var jobs JobStore
+
+// JobReporter is told about the phases of a running analysis and the number of files blamed
+type JobReporter interface {
+	Phase(state JobState)
+	Progress(files, totalFiles int)
+}
+
+func reportPhase(report JobReporter, state JobState) {
+	if report != nil {
+		report.Phase(state)
+	}
+}
+
+func reportProgress(report JobReporter, files, totalFiles int) {
+	if report != nil {
+		report.Progress(files, totalFiles)
+	}
+}
+
+// jobsWakeup makes the worker loop look for jobs without waiting for the next poll
+var jobsWakeup = make(chan bool, 1)
+
+func wakeupWorker() {
+	select {
+	case jobsWakeup <- true:
+	default:
+	}
+}
+
+func newJob(rc RepoConfig, refresh bool, node string) *Job {
+	now := time.Now()
+	return &Job{Hash: rc.Hash(), Config: rc, State: JobQueued, Refresh: refresh, Worker: node, Created: now, Updated: now}
+}
+
+type mongoJobStore struct{}
+
+func (s mongoJobStore) collection() (*mgo.Collection, func()) {
+	session := mongoSession.Clone()
+	return session.DB("gf").C("jobs"), session.Close
+}
+
+func (s mongoJobStore) Enqueue(rc RepoConfig, refresh bool, node string) (*Job, error) {
+	c, done := s.collection()
+	defer done()
+
+	job := newJob(rc, refresh, node)
+	err := c.Insert(job)
+	if err == nil {
+		return job, nil
+	}
+	if !mgo.IsDup(err) {
+		return nil, err
+	}
+
+	existing := Job{}
+	if err = c.FindId(job.Hash).One(&existing); err != nil {
+		return nil, err
+	}
+	if existing.State == JobFailed || existing.State == JobDone && refresh {
+		err = c.Update(bson.M{"_id": job.Hash, "state": existing.State}, bson.M{"$set": bson.M{"state": JobQueued, "refresh": refresh, "config": rc, "worker": node, "attempts": 0, "retryat": time.Time{}, "updated": time.Now()}})
+		if err != nil && err != mgo.ErrNotFound {
+			return nil, err
+		}
+		existing.State = JobQueued
+		existing.Worker = node
+		existing.Attempts = 0
+		existing.RetryAt = time.Time{}
+	} else if existing.State == JobQueued && existing.Worker != node {
+		// the server moved the repo to another worker, the old one is down
+		err = c.Update(bson.M{"_id": job.Hash, "state": JobQueued}, bson.M{"$set": bson.M{"worker": node}})
+		if err != nil && err != mgo.ErrNotFound {
+			return nil, err
+		}
+		existing.Worker = node
+	}
+	return &existing, nil
+}
+
+func (s mongoJobStore) Claim(owner, node string) (*Job, error) {
+	c, done := s.collection()
+	defer done()
+
+	now := time.Now()
+	// give up jobs out of attempts instead of taking them again, refreshes keep the old result as on failures
+	abandoned := bson.M{"state": bson.M{"$in": activeJobStates}, "leaseuntil": bson.M{"$lt": now}, "attempts": bson.M{"$gte": JOB_MAX_ATTEMPTS}}
+	_, err := c.UpdateAll(bson.M{"$and": []bson.M{abandoned, {"refresh": true, "result": bson.M{"$exists": true}}}},
+		bson.M{"$set": bson.M{"state": JobDone, "error": "", "refresh": false, "leaseowner": "", "updated": now}})
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.UpdateAll(abandoned, bson.M{"$set": bson.M{"state": JobFailed, "error": errJobAbandoned.Error(), "leaseowner": "", "updated": now}})
+	if err != nil {
+		return nil, err
+	}
+
+	job := Job{}
+	_, err = c.Find(bson.M{"$or": []bson.M{
+		{"state": JobQueued, "worker": bson.M{"$in": []string{node, ""}}, "retryat": bson.M{"$not": bson.M{"$gt": now}}},
+		{"state": bson.M{"$in": activeJobStates}, "leaseuntil": bson.M{"$lt": now}, "attempts": bson.M{"$lt": JOB_MAX_ATTEMPTS}},
+	}}).Sort("updated").Apply(mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{"state": JobCloning, "leaseowner": owner, "leaseuntil": now.Add(JOB_LEASE), "updated": now},
+			"$inc": bson.M{"attempts": 1},
+		},
+		ReturnNew: true,
+	}, &job)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s mongoJobStore) update(hash, owner string, set bson.M) error {
+	c, done := s.collection()
+	defer done()
+
+	set["updated"] = time.Now()
+	err := c.Update(bson.M{"_id": hash, "leaseowner": owner, "state": bson.M{"$in": activeJobStates}}, bson.M{"$set": set})
+	if err == mgo.ErrNotFound {
+		return errLeaseLost
+	}
+	return err
+}
+
+func (s mongoJobStore) Renew(hash, owner string) error {
+	return s.update(hash, owner, bson.M{"leaseuntil": time.Now().Add(JOB_LEASE)})
+}
+
+func (s mongoJobStore) SetState(hash, owner string, state JobState) error {
+	return s.update(hash, owner, bson.M{"state": state, "leaseuntil": time.Now().Add(JOB_LEASE)})
+}
+
+func (s mongoJobStore) Finish(hash, owner string, result *Repo) error {
+	return s.update(hash, owner, bson.M{"state": JobDone, "result": result, "error": "", "refresh": false, "leaseowner": ""})
+}
+
+func (s mongoJobStore) Fail(hash, owner string, reason error) error {
+	return s.update(hash, owner, bson.M{"state": JobFailed, "error": reason.Error(), "leaseowner": ""})
+}
+
+func (s mongoJobStore) Retry(hash, owner string, reason error, at time.Time) error {
+	return s.update(hash, owner, bson.M{"state": JobQueued, "error": reason.Error(), "retryat": at, "leaseowner": ""})
+}
+
+func (s mongoJobStore) Cancel(hash string, reason error) (bool, error) {
+	c, done := s.collection()
+	defer done()
+
+	err := c.Update(bson.M{"_id": hash, "state": JobQueued}, bson.M{"$set": bson.M{"state": JobFailed, "error": reason.Error(), "updated": time.Now()}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s mongoJobStore) Get(hashes []string) ([]*Job, error) {
+	c, done := s.collection()
+	defer done()
+
+	var res []*Job
+	err := c.Find(bson.M{"_id": bson.M{"$in": hashes}}).All(&res)
+	return res, err
+}
+
+// memoryJobStore is used when the worker runs without MongoDB. Jobs are lost on restart
+type memoryJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+func newMemoryJobStore() *memoryJobStore {
+	return &memoryJobStore{jobs: make(map[string]*Job)}
+}
+
+func (s *memoryJobStore) Enqueue(rc RepoConfig, refresh bool, node string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := newJob(rc, refresh, node)
+	existing, exists := s.jobs[job.Hash]
+	if !exists {
+		s.jobs[job.Hash] = job
+		copy := *job
+		return &copy, nil
+	}
+	if existing.State == JobFailed || existing.State == JobDone && refresh {
+		existing.State = JobQueued
+		existing.Refresh = refresh
+		existing.Config = rc
+		existing.Attempts = 0
+		existing.RetryAt = time.Time{}
+		existing.Updated = time.Now()
+	}
+	if existing.State == JobQueued {
+		existing.Worker = node
+	}
+	copy := *existing
+	return &copy, nil
+}
+
+func (s *memoryJobStore) Claim(owner, node string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var oldest *Job
+	for _, job := range s.jobs {
+		expired := job.isActive() && job.LeaseUntil.Before(now)
+		if expired && job.Attempts >= JOB_MAX_ATTEMPTS {
+			// refreshes keep the old result as on failures
+			if job.Refresh && job.Result != nil {
+				job.State = JobDone
+				job.Error = ""
+				job.Refresh = false
+			} else {
+				job.State = JobFailed
+				job.Error = errJobAbandoned.Error()
+			}
+			job.LeaseOwner = ""
+			job.Updated = now
+			continue
+		}
+		queued := job.State == JobQueued && (job.Worker == node || job.Worker == "") && !job.RetryAt.After(now)
+		if queued || expired {
+			if oldest == nil || job.Updated.Before(oldest.Updated) {
+				oldest = job
+			}
+		}
+	}
+	if oldest == nil {
+		return nil, nil
+	}
+	oldest.State = JobCloning
+	oldest.LeaseOwner = owner
+	oldest.LeaseUntil = now.Add(JOB_LEASE)
+	oldest.Updated = now
+	oldest.Attempts++
+	copy := *oldest
+	return &copy, nil
+}
+
+func (s *memoryJobStore) update(hash, owner string, f func(job *Job)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, exists := s.jobs[hash]
+	if !exists || job.LeaseOwner != owner || !job.isActive() {
+		return errLeaseLost
+	}
+	f(job)
+	job.Updated = time.Now()
+	return nil
+}
+
+func (s *memoryJobStore) Renew(hash, owner string) error {
+	return s.update(hash, owner, func(job *Job) {
+		job.LeaseUntil = time.Now().Add(JOB_LEASE)
+	})
+}
+
+func (s *memoryJobStore) SetState(hash, owner string, state JobState) error {
+	return s.update(hash, owner, func(job *Job) {
+		job.State = state
+		job.LeaseUntil = time.Now().Add(JOB_LEASE)
+	})
+}
+
+func (s *memoryJobStore) Finish(hash, owner string, result *Repo) error {
+	return s.update(hash, owner, func(job *Job) {
+		job.State = JobDone
+		job.Result = result
+		job.Error = ""
+		job.Refresh = false
+		job.LeaseOwner = ""
+	})
+}
+
+func (s *memoryJobStore) Fail(hash, owner string, reason error) error {
+	return s.update(hash, owner, func(job *Job) {
+		job.State = JobFailed
+		job.Error = reason.Error()
+		job.LeaseOwner = ""
+	})
+}
+
+func (s *memoryJobStore) Retry(hash, owner string, reason error, at time.Time) error {
+	return s.update(hash, owner, func(job *Job) {
+		job.State = JobQueued
+		job.Error = reason.Error()
+		job.RetryAt = at
+		job.LeaseOwner = ""
+	})
+}
+
+func (s *memoryJobStore) Cancel(hash string, reason error) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, exists := s.jobs[hash]
+	if !exists || job.State != JobQueued {
+		return false, nil
+	}
+	job.State = JobFailed
+	job.Error = reason.Error()
+	job.Updated = time.Now()
+	return true, nil
+}
+
+func (s *memoryJobStore) Get(hashes []string) ([]*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var res []*Job
+	for _, hash := range hashes {
+		if job, exists := s.jobs[hash]; exists {
+			copy := *job
+			res = append(res, &copy)
+		}
+	}
+	return res, nil
+}
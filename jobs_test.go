@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// expireLease makes the job look like its worker died
+func expireLease(s *memoryJobStore, hash string) {
+	s.mu.Lock()
+	s.jobs[hash].LeaseUntil = time.Now().Add(-time.Second)
+	s.mu.Unlock()
+}
+
+func TestMemoryJobStoreAbandonsCrashingJobs(t *testing.T) {
+	s := newMemoryJobStore()
+	job, err := s.Enqueue(RepoConfig{URL: "https://github.com/owner/crash"}, false, "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 1; attempt <= JOB_MAX_ATTEMPTS; attempt++ {
+		claimed, err := s.Claim("worker"+strconv.Itoa(attempt), "node")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed == nil || claimed.Hash != job.Hash || claimed.Attempts != attempt {
+			t.Fatalf("attempt %d: claimed %+v", attempt, claimed)
+		}
+		if again, _ := s.Claim("other", "node"); again != nil {
+			t.Fatalf("attempt %d: job claimed again while leased", attempt)
+		}
+		expireLease(s, job.Hash)
+	}
+
+	if claimed, _ := s.Claim("worker", "node"); claimed != nil {
+		t.Fatalf("claimed after %d attempts: %+v", claimed.Attempts, claimed)
+	}
+	found, _ := s.Get([]string{job.Hash})
+	if len(found) != 1 || found[0].State != JobFailed || found[0].Error != errJobAbandoned.Error() {
+		t.Fatalf("got %+v, want a failed job", found)
+	}
+
+	// failed jobs may be queued again
+	if job, _ = s.Enqueue(job.Config, false, "node"); job.State != JobQueued || job.Attempts != 0 {
+		t.Errorf("got %+v, want a queued job", job)
+	}
+}
+
+func TestMemoryJobStoreAbandonedRefreshKeepsResult(t *testing.T) {
+	s := newMemoryJobStore()
+	rc := RepoConfig{URL: "https://github.com/owner/refresh"}
+	job, _ := s.Enqueue(rc, false, "node")
+	s.Claim("worker", "node")
+	result := &Repo{Hash: job.Hash, Stat: &RepoStat{Commit: "old"}}
+	if err := s.Finish(job.Hash, "worker", result); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Enqueue(rc, true, "node")
+	for attempt := 1; attempt <= JOB_MAX_ATTEMPTS; attempt++ {
+		if claimed, _ := s.Claim("worker", "node"); claimed == nil {
+			t.Fatalf("attempt %d: nothing claimed", attempt)
+		}
+		expireLease(s, job.Hash)
+	}
+	if claimed, _ := s.Claim("worker", "node"); claimed != nil {
+		t.Fatalf("claimed after %d attempts", claimed.Attempts)
+	}
+	found, _ := s.Get([]string{job.Hash})
+	if len(found) != 1 || found[0].State != JobDone || found[0].Result != result || found[0].Refresh {
+		t.Errorf("got %+v, want the old result done", found)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	svg "github.com/ajstarks/svgo"
+)
+
+const LABEL_STYLE = "font-family:sans-serif;font-size:14px;fill:rgb(60,60,60)"
+
+// the title block takes the top left corner, other text starts below it
+const TITLE_BLOCK_HEIGHT = 56
+
+const LEGEND_WIDTH = 200
+const LEGEND_ROW_HEIGHT = 20
+
+func userName(u *UserStat) string {
+	if u.Username != "" {
+		return u.Username
+	}
+	return u.Email
+}
+
+func percent(lines, total int) int {
+	if total == 0 {
+		return 0
+	}
+	return int(100 * float64(lines) / float64(total))
+}
+
+// towerTitle describes the lines a tower stands for
+func towerTitle(name string, lines, total int, townType TownType) string {
+	return fmt.Sprintf("%s: %d lines of %s (%d%%)", name, lines, strings.ToLower(TOWN_NAMES[townType]), percent(lines, total))
+}
+
+// windowLabel describes the lines of the window, empty for all lines
+func windowLabel(window string, now time.Time) string {
+	if from, to, isRange := splitMonthRange(window); isRange {
+		switch {
+		case from == "":
+			return "lines changed until " + to
+		case to == "":
+			return "lines changed since " + from
+		}
+		return "lines changed from " + from + " to " + to
+	}
+	if _, named := WINDOW_MONTHS[window]; named {
+		return "lines changed since " + windowStart(window, now)
+	}
+	return ""
+}
+
+// drawTitleBlock writes the repo name, the analyzed commit, its date and the window in the top left corner
+func drawTitleBlock(canvas *svg.SVG, repo *Repo, rs *RepoStat, window string) {
+	canvas.Text(CANVAS_PADDING, CANVAS_PADDING, repo.Owner+"/"+repo.Name, LABEL_STYLE+";font-size:22px;font-weight:bold")
+
+	var info []string
+	if repo.Ref != "" {
+		info = append(info, repo.Ref)
+	}
+	commit := rs.Commit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	if commit != "" {
+		info = append(info, "commit "+commit)
+	}
+	if !rs.CommitTime.IsZero() {
+		info = append(info, rs.CommitTime.UTC().Format("2006-01-02"))
+	}
+	if label := windowLabel(window, time.Now()); label != "" {
+		info = append(info, label)
+	}
+	canvas.Text(CANVAS_PADDING, CANVAS_PADDING+22, strings.Join(info, " · "), LABEL_STYLE)
+}
+
+// drawDistrictLabels names the drawn districts along the front edge of the floor
+func drawDistrictLabels(canvas *svg.SVG, f *Field, towns []TownType) {
+	for _, townType := range towns {
+		minRow, maxRow := -1, -1
+		for id, cellType := range f.CellType {
+			if cellType != townType {
+				continue
+			}
+			if row := id / CELLS_SIDE; minRow == -1 || row < minRow {
+				minRow = row
+			}
+			if row := id / CELLS_SIDE; row > maxRow {
+				maxRow = row
+			}
+		}
+		if minRow == -1 {
+			continue
+		}
+		x, y := isoPos(CELLS_SIDE*(CellSize+CELL_PADDING), (minRow+maxRow+1)*(CellSize+CELL_PADDING)/2, 0)
+		canvas.Text(x-8, y+4, TOWN_NAMES[townType], LABEL_STYLE+";font-weight:bold;text-anchor:end")
+	}
+}
+
+// drawLegend lists the users having towers with their colors and share of the drawn lines in the top right corner
+func drawLegend(canvas *svg.SVG, f *Field, rs *RepoStat, towns []TownType, window string) {
+	colors := make(map[string]Color)
+	for _, tower := range f.Towers {
+		if tower.Email != "" {
+			colors[tower.Email] = tower.Color
+		}
+	}
+	total := 0
+	for _, townType := range towns {
+		total += getRepoTotal(rs, townType, window)
+	}
+
+	x := CANVAS_WIDTH - CANVAS_PADDING - LEGEND_WIDTH
+	y := CANVAS_PADDING
+	others := total
+	for _, u := range rs.Users {
+		color, exists := colors[u.Email]
+		if !exists {
+			continue
+		}
+		lines := 0
+		for _, townType := range towns {
+			lines += getUserTotal(u, townType, window)
+		}
+		others -= lines
+		canvas.Rect(x, y-12, 14, 14, fill(color.R, color.G, color.B))
+		canvas.Text(x+22, y, fmt.Sprintf("%s %d%%", userName(u), percent(lines, total)), LABEL_STYLE)
+		y += LEGEND_ROW_HEIGHT
+	}
+	canvas.Rect(x, y-12, 14, 14, fill(200, 200, 200))
+	canvas.Text(x+22, y, fmt.Sprintf("Other contributors %d%%", percent(others, total)), LABEL_STYLE)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// per-job limits, 0 means unlimited
+var (
+	jobTimeout         = 30 * time.Minute
+	maxRepoSize  int64 = 2 << 30
+	maxRepoFiles       = 50000
+	// larger files are skipped
+	maxFileSize int64 = 2 << 20
+)
+
+// how often a running clone is measured against maxRepoSize
+const CLONE_SIZE_CHECK_INTERVAL = time.Second
+
+var errJobCanceled error = &JobError{Reason: "Canceled"}
+
+// checkRepoSize fails for mirrors larger than maxRepoSize, history included
+func checkRepoSize(repoPath string) error {
+	if maxRepoSize <= 0 {
+		return nil
+	}
+	if size := dirSize(filepath.Join(repoPath, ".git")); size > maxRepoSize {
+		return repoSizeError(size)
+	}
+	return nil
+}
+
+func repoSizeError(size int64) error {
+	return permanentError("Repo is %d MB, the limit is %d MB", size>>20, maxRepoSize>>20)
+}
+
+// watchCloneSize cancels a running clone once dir grows over maxRepoSize, so a huge repo is never downloaded in full.
+// The returned func reports the size error after the clone exited
+func watchCloneSize(ctx context.Context, dir string, cancel context.CancelFunc) func() error {
+	if maxRepoSize <= 0 {
+		return func() error { return nil }
+	}
+
+	var mu sync.Mutex
+	var exceeded error
+	go func() {
+		ticker := time.NewTicker(CLONE_SIZE_CHECK_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if size := dirSize(dir); size > maxRepoSize {
+					mu.Lock()
+					exceeded = repoSizeError(size)
+					mu.Unlock()
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return exceeded
+	}
+}
+
+// jobContextError replaces errors of killed git processes with the reason the job context is done
+func jobContextError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return permanentError("Timed out after %v", jobTimeout)
+	case context.Canceled:
+		return errJobCanceled
+	}
+	return err
+}
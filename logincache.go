@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// logins are re-resolved after that, accounts may be renamed
+const LOGIN_CACHE_TTL = 30 * 24 * time.Hour
+
+type cachedLogin struct {
+	Key     string `bson:"_id"`
+	Login   string
+	Updated time.Time
+}
+
+// loginCache maps "host/email/<email>" and "host/commit/<sha>" keys to account logins.
+// It's stored in the "logins" collection next to repostats when MongoDB is available
+type loginCache struct {
+	mu     sync.Mutex
+	memory map[string]string
+}
+
+var logins = &loginCache{memory: make(map[string]string)}
+
+func (c *loginCache) collection() (*mgo.Collection, func()) {
+	if mongoSession == nil {
+		return nil, func() {}
+	}
+	s := mongoSession.Clone()
+	return s.DB("gf").C("logins"), s.Close
+}
+
+func (c *loginCache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	login, exists := c.memory[key]
+	c.mu.Unlock()
+	if exists {
+		return login, true
+	}
+
+	col, done := c.collection()
+	defer done()
+	if col == nil {
+		return "", false
+	}
+	cached := cachedLogin{}
+	if err := col.FindId(key).One(&cached); err != nil || time.Since(cached.Updated) > LOGIN_CACHE_TTL {
+		return "", false
+	}
+
+	c.mu.Lock()
+	c.memory[key] = cached.Login
+	c.mu.Unlock()
+	return cached.Login, true
+}
+
+func (c *loginCache) Set(key, login string) {
+	c.mu.Lock()
+	c.memory[key] = login
+	c.mu.Unlock()
+
+	col, done := c.collection()
+	defer done()
+	if col == nil {
+		return
+	}
+	if _, err := col.UpsertId(key, bson.M{"$set": bson.M{"login": login, "updated": time.Now()}}); err != nil {
+		log.WithError(err).Error("Can't save login to cache")
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"errors"
 	"net/url"
+	"regexp"
 	"strings"
 
 	"flag"
@@ -17,6 +18,7 @@ import (
 	"time"
 
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"sync"
 
@@ -27,20 +29,22 @@ import (
 )
 
 var (
-	mongoSession  *mgo.Session
-	mongo         *mgo.DialInfo
-	workerBaseURL = "http://127.0.0.1:7777/"
+	mongoSession *mgo.Session
+	mongo        *mgo.DialInfo
 )
 
+func mongoURL() string {
+	if d := os.Getenv("GFMONGO"); d != "" {
+		return d
+	}
+	return "mongodb://localhost:27017"
+}
+
 func dbConnect() {
 
-	uri := "mongodb://localhost:27017"
+	uri := mongoURL()
 	var err error
 
-	if d := os.Getenv("GFWORKER"); d != "" {
-		workerBaseURL = d
-	}
-
 	mongo, _ = mgo.ParseURL(uri)
 	mongoConnected := false
 	for mongoConnected == false {
@@ -55,44 +59,101 @@ func dbConnect() {
 	mongoSession.SetSafe(nil)
 
 }
+
+// workerDBConnect connects the worker to MongoDB. Jobs and logins are kept in memory without it
+func workerDBConnect() {
+	session, err := mgo.DialWithTimeout(mongoURL(), 5*time.Second)
+	if err != nil {
+		log.WithError(err).WithField("url", mongoURL()).Warn("Running without MongoDB, jobs and logins are kept in memory only")
+		return
+	}
+	mongoSession = session
+	mongoSession.SetSafe(nil)
+}
 func (r *RepoConfig) Hash() string {
 	h, o, n, _ := r.ParseURL()
-	return MD5(h + "/" + o + "/" + n)
+	key := h + "/" + o + "/" + n
+	if r.Ref != "" {
+		key += "@" + r.Ref
+	}
+	if r.AsOf != "" {
+		key += "@{" + r.AsOf + "}"
+	}
+	return MD5(key)
 }
 func (r *RepoConfig) Repo() *Repo {
 	host, owner, name, _ := r.ParseURL()
-	return &Repo{Hash: r.Hash(), Host: host, Owner: owner, Name: name}
+	return &Repo{Hash: r.Hash(), Host: host, Owner: owner, Name: name, Ref: r.Ref, AsOf: r.AsOf}
 }
 
-func (r *RepoConfig) ParseURL() (host, owner, name string, err error) {
+// repo hosts, IPv6 addresses come without brackets from url.Hostname
+var repoHostRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.:-]*$`)
+
+// checkRepoURL allows only https://, ssh:// and git@host: URLs, so a repo given by a user can't make git
+// read local files, run transport helpers or take the URL for an option
+func checkRepoURL(rawURL string) error {
+	var host string
+	switch {
+	case strings.HasPrefix(rawURL, "https://"), strings.HasPrefix(rawURL, "ssh://"):
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return err
+		}
+		host = u.Hostname()
+	case strings.HasPrefix(rawURL, "git@"):
+		x := strings.Index(rawURL, ":")
+		if x < 0 {
+			return errors.New("Bad URL, expected git@host:owner/repo: " + rawURL)
+		}
+		host = rawURL[len("git@"):x]
+	default:
+		return errors.New("Unsupported URL, expected https://, ssh:// or git@host:owner/repo: " + rawURL)
+	}
+	if !repoHostRegexp.MatchString(host) {
+		return errors.New("Bad host in URL: " + rawURL)
+	}
+	return nil
+}
 
-	x := strings.Index(r.URL, ":")
-	if x < 0 {
-		err = errors.New("Bad URL")
+// ParseURL splits the repo URL into host, owner and name. The owner keeps GitLab subgroups, e.g. group/subgroup
+func (r *RepoConfig) ParseURL() (host, owner, name string, err error) {
+	if err = checkRepoURL(r.URL); err != nil {
 		return
 	}
-	path := strings.Split(r.URL[x:], "/")
-	if path[len(path)-1] == "" {
-		owner = strings.ToLower(path[len(path)-3])
-		name = strings.ToLower(path[len(path)-2])
+
+	var repoPath string
+	if strings.Contains(r.URL, "://") {
+		u, perr := url.Parse(r.URL)
+		if perr != nil {
+			return "", "", "", perr
+		}
+		host = strings.ToLower(u.Hostname())
+		repoPath = u.Path
 	} else {
-		owner = strings.ToLower(path[len(path)-2])
-		name = strings.ToLower(path[len(path)-1])
+		// scp-like syntax: git@host:owner/repo
+		x := strings.Index(r.URL, ":")
+		host = strings.ToLower(r.URL[strings.Index(r.URL, "@")+1 : x])
+		repoPath = r.URL[x+1:]
 	}
-	if strings.Contains(r.URL, "://") {
-		u, err := url.Parse(r.URL)
-		if err != nil {
-			return "", "", "", err
+
+	var segments []string
+	for _, s := range strings.Split(repoPath, "/") {
+		if s == "" {
+			continue
 		}
-		host = strings.ToLower(u.Host)
-		if d := strings.Index(host, ":"); d > -1 {
-			host = host[0:d]
+		if s == "." || s == ".." {
+			return "", "", "", errors.New("Bad URL path: " + r.URL)
 		}
-
-	} else {
-		host = host[strings.Index(host, "@")+1 : strings.Index(host, ":")]
+		segments = append(segments, strings.ToLower(s))
+	}
+	if len(segments) < 2 {
+		return "", "", "", errors.New("Bad URL, expected owner/repo: " + r.URL)
+	}
+	owner = strings.Join(segments[:len(segments)-1], "/")
+	name = strings.TrimSuffix(segments[len(segments)-1], ".git")
+	if name == "" {
+		return "", "", "", errors.New("Bad URL, expected owner/repo: " + r.URL)
 	}
-	name = strings.TrimSuffix(name, ".git")
 
 	return
 }
@@ -103,6 +164,23 @@ func (r *RepoConfig) ParseURL() (host, owner, name string, err error) {
 	db.C("email2login").Find(bson.M{"_id": id}).One(title)
 }*/
 
+// repoURLFromInput accepts owner/repo (GitHub), host:owner/repo or a https://, ssh:// or git@host: clone URL
+func repoURLFromInput(input string) (string, error) {
+	input = strings.TrimSpace(input)
+	if strings.HasPrefix(input, "-") {
+		return "", errors.New("Bad repo: " + input)
+	}
+	rc := RepoConfig{URL: input}
+	if !strings.Contains(input, "://") && !strings.Contains(input, "@") {
+		rc.URL = "https://github.com/" + input
+		if x := strings.Index(input, ":"); x > 0 {
+			rc.URL = "https://" + input[0:x] + "/" + strings.TrimPrefix(input[x+1:], "/")
+		}
+	}
+	_, _, _, err := rc.ParseURL()
+	return rc.URL, err
+}
+
 func (r *Repo) getCachedStat() *RepoStat {
 	db := mongoSession.Clone().DB("gf")
 	defer db.Session.Close()
@@ -110,109 +188,345 @@ func (r *Repo) getCachedStat() *RepoStat {
 	cachedRepo := Repo{}
 	db.C("repostats").Find(bson.M{"hash": r.Hash}).One(&cachedRepo)
 
-	if cachedRepo.Hash != "" {
+	if cachedRepo.Hash != "" && cachedRepo.Stat != nil {
+		// windows stored at analysis time have moved since
+		cachedRepo.Stat.Derive(time.Now())
 		return cachedRepo.Stat
 	}
 	return nil
 }
 
-var tokensToFetch []string
+// saveSVGs renders all lines of the repo into frontend/svgs/<hash>.svg. The named windows move with
+// the current date, so they aren't saved, /draw renders them on request
+func saveSVGs(repo Repo) {
+	if !exists("frontend/svgs/") {
+		os.MkdirAll("frontend/svgs/", 0777)
+	}
+
+	f, err := os.Create("frontend/svgs/" + repo.Hash + ".svg")
+	if err != nil {
+		log.WithError(err).Error("Can't save SVG")
+		return
+	}
+	defer f.Close()
+	repo.DrawStat(f, repo.Stat, DrawOptions{})
+}
+
+// users sent to the page by /check, the rest are available through /api/v1
+const CHECK_MAX_USERS = 50
+
+// repo queued on a worker and not saved yet
+type pendingRepo struct {
+	config  RepoConfig
+	refresh bool
+	worker  string
+}
+
+var pendingRepos = make(map[string]*pendingRepo)
 var mu sync.Mutex
 
-func repoQuery(repoURL string) {
-	rc := RepoConfig{URL: repoURL}
-	hash := rc.Hash()
-	for _, x := range tokensToFetch {
+// queryWorker queues the repo on the worker owning its hash, trying the next worker on the ring while they are down
+func queryWorker(rc RepoConfig, refresh bool) (string, error) {
+	params := url.Values{}
+	if rc.Ref != "" {
+		params.Set("ref", rc.Ref)
+	}
+	if rc.AsOf != "" {
+		params.Set("asof", rc.AsOf)
+	}
+	if refresh {
+		params.Set("refresh", "1")
+	}
 
-		if x == hash {
-			return
+	hash := rc.Hash()
+	for {
+		worker, err := workers.WorkerFor(hash)
+		if err != nil {
+			return "", err
 		}
-	}
 
-	c := http.DefaultClient
-	req, _ := http.NewRequest("POST", workerBaseURL+"query", strings.NewReader(repoURL))
-	resp, err := c.Do(req)
-	if resp != nil && resp.StatusCode == 200 {
-		defer resp.Body.Close()
+		req, _ := http.NewRequest("POST", worker+"query?"+params.Encode(), strings.NewReader(rc.URL))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.WithError(err).WithField("worker", worker).Error("Can't request worker")
+			workers.MarkDown(worker)
+			continue
+		}
 		contents, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 
-		if len(contents) == 32 {
-			mu.Lock()
-			tokensToFetch = append(tokensToFetch, string(contents))
-			mu.Unlock()
+		if resp.StatusCode != 200 || len(contents) != 32 {
+			return "", errors.New("Worker query: " + resp.Status)
 		}
-	} else {
+		return worker, nil
+	}
+}
+
+// dropPending stops waiting for a repo whose job failed
+func dropPending(hash string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(pendingRepos, hash)
+}
+
+func repoQuery(rc RepoConfig, refresh bool) {
+	hash := rc.Hash()
+	mu.Lock()
+	_, exists := pendingRepos[hash]
+	mu.Unlock()
+	if exists {
+		return
+	}
+
+	worker, err := queryWorker(rc, refresh)
+	if err != nil {
 		log.WithError(err).Error("Can't request worker")
+		return
 	}
+
+	mu.Lock()
+	pendingRepos[hash] = &pendingRepo{config: rc, refresh: refresh, worker: worker}
+	mu.Unlock()
 }
 
-func tokensFetchLoop() {
-	db := mongoSession.Clone().DB("gf")
-	defer db.Session.Close()
+// workerProgress asks the worker about the job, nil means the worker doesn't know it
+func workerProgress(hash string) (*JobProgress, error) {
+	worker, err := workers.WorkerFor(hash)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Get(worker + "progress/" + url.PathEscape(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 
-	c := http.DefaultClient
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Worker progress: " + resp.Status)
+	}
+	p := JobProgress{}
+	if err = json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
 
-	for {
-		if len(tokensToFetch) > 0 {
-			req, _ := http.NewRequest("POST", workerBaseURL+"check", strings.NewReader(strings.Join(tokensToFetch, ",")))
-			resp, err := c.Do(req)
-			if resp != nil && resp.StatusCode == 200 {
+// progressHandler streams job progress as Server-Sent Events until the stat is saved or the job fails
+func progressHandler(c *gin.Context) {
+	repoURL, err := repoURLFromInput(c.Query("repo"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "error": err.Error()})
+		return
+	}
+	rc := RepoConfig{URL: repoURL, Ref: c.Query("ref"), AsOf: c.Query("asof")}
+	repo := rc.Repo()
 
-				defer resp.Body.Close()
+	c.Stream(func(w io.Writer) bool {
+		p, err := workerProgress(repo.Hash)
+		if err != nil {
+			log.WithError(err).Error("Can't request worker")
+		}
 
-				decoder := json.NewDecoder(resp.Body)
-				var data map[string]Repo
+		switch {
+		case p != nil && p.State == JobFailed:
+			dropPending(repo.Hash)
+			c.SSEvent("failed", p)
+			return false
+		case (p == nil || p.State == JobDone) && repo.getCachedStat() != nil:
+			// the stat is ready once tokensFetchLoop saved it, not when the worker finished
+			c.SSEvent("ready", gin.H{"hash": repo.Hash})
+			return false
+		case p != nil:
+			c.SSEvent("progress", p)
+		}
+		time.Sleep(time.Second)
+		return true
+	})
+}
 
-				err = decoder.Decode(&data)
+// fetchReady returns the repos of hashes the worker has finished
+func fetchReady(worker string, hashes []string) (map[string]Repo, error) {
+	req, _ := http.NewRequest("POST", worker+"check", strings.NewReader(strings.Join(hashes, ",")))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Worker check: " + resp.Status)
+	}
+	var data map[string]Repo
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	return data, err
+}
+
+// fetchFailed returns failure reasons of hashes the worker gave up on
+func fetchFailed(worker string, hashes []string) (map[string]string, error) {
+	req, _ := http.NewRequest("POST", worker+"failed", strings.NewReader(strings.Join(hashes, ",")))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Worker failed: " + resp.Status)
+	}
+	var data map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	return data, err
+}
+
+func tokensFetchLoop() {
+	db := mongoSession.Clone().DB("gf")
+	defer db.Session.Close()
+
+	for {
+		byWorker := make(map[string][]string)
+		var moved []*pendingRepo
+
+		mu.Lock()
+		for hash, p := range pendingRepos {
+			worker, err := workers.WorkerFor(hash)
+			if err != nil {
+				continue
+			}
+			if worker != p.worker {
+				moved = append(moved, p)
+				continue
+			}
+			byWorker[worker] = append(byWorker[worker], hash)
+		}
+		mu.Unlock()
+
+		// the worker of these repos is down, queue them on the workers taking over their hashes
+		for _, p := range moved {
+			worker, err := queryWorker(p.config, p.refresh)
+			if err != nil {
+				log.WithError(err).Error("Can't request worker")
+				continue
+			}
+			mu.Lock()
+			p.worker = worker
+			mu.Unlock()
+		}
 
-				if err != nil {
-					log.WithError(err).Error("can't decode repostat")
+		for worker, hashes := range byWorker {
+			data, err := fetchReady(worker, hashes)
+			if err != nil {
+				log.WithError(err).WithField("worker", worker).Error("can't fetch repostats")
+				continue
+			}
+			for hash, repo := range data {
+				dropPending(hash)
+				if _, err := db.C("repostats").Upsert(bson.M{"hash": repo.Hash}, repo); err != nil {
+					log.WithError(err).WithField("repo", repo.Hash).Error("Can't save repostat")
 					continue
 				}
-				if len(data) > 0 {
-					for _, repo := range data {
-
-						db.C("repostats").Insert(repo)
-						go func() {
-							if !exists("frontend/svgs/") {
-								os.MkdirAll("frontend/svgs/", 0777)
-							}
-
-							f, err := os.Create("frontend/svgs/" + repo.Hash + ".svg")
-							if err != nil {
-								log.WithError(err).Error("Can't save SVG")
-							}
-							defer f.Close()
-
-							repo.Draw(f)
-
-						}()
-					}
-					b := tokensToFetch[:0]
-					for _, x := range tokensToFetch {
-						if _, exists := data[x]; !exists {
-							b = append(b, x)
-						}
-					}
-					tokensToFetch = b
-				}
+				go saveSVGs(repo)
+			}
+
+			failed, err := fetchFailed(worker, hashes)
+			if err != nil {
+				log.WithError(err).WithField("worker", worker).Error("can't fetch failed jobs")
+				continue
+			}
+			for hash, reason := range failed {
+				log.WithField("hash", hash).WithField("reason", reason).Warn("Repo analysis failed")
+				dropPending(hash)
 			}
 		}
 		time.Sleep(time.Second)
 	}
 }
 
+// defaultWorkers reads the worker list from GFWORKERS or the single GFWORKER
+func defaultWorkers() string {
+	if w := os.Getenv("GFWORKERS"); w != "" {
+		return w
+	}
+	if w := os.Getenv("GFWORKER"); w != "" {
+		return w
+	}
+	return "http://127.0.0.1:7777/"
+}
+
 func main() {
 	worker := flag.Bool("worker", false, "Run in worker mode")
+	flag.BoolVar(&skipGenerated, "skip-generated", false, "Drop generated files instead of counting them as generated lines")
+	flag.DurationVar(&mirrorMaxAge, "mirror-max-age", mirrorMaxAge, "Fetch cloned repos older than that before analysis")
+	reposBudgetMB := flag.Int64("repos-budget", reposDiskBudget>>20, "Disk budget for cloned repos in MB, 0 for unlimited")
+	hosts := flag.String("hosts", os.Getenv("GFHOSTS"), "Self-hosted git servers as host=github|gitlab|gitea,...")
+	aliases := flag.String("aliases", os.Getenv("GFALIASES"), "File with email aliases in .mailmap format")
+	githubTokens := flag.String("github-tokens", githubTokensEnv(), "Comma-separated GitHub API tokens, usernames are not resolved without them. Defaults to GFGITHUB_TOKENS or GFGITHUB_TOKEN")
+	listen := flag.String("listen", ":7777", "Worker listen address")
+	advertise := flag.String("advertise", os.Getenv("GFADVERTISE"), "Worker URL the server reaches it at, http://127.0.0.1<listen>/ by default")
+	register := flag.String("register", os.Getenv("GFREGISTER"), "Server URL the worker registers itself at")
+	flag.StringVar(&registerSecret, "register-secret", os.Getenv("GFREGISTER_SECRET"), "Shared secret of the server and its workers, /register is disabled without it")
+	flag.StringVar(&reposDir, "repos-dir", reposDir, "Directory of cloned repos, each worker needs its own")
+	flag.DurationVar(&jobTimeout, "job-timeout", jobTimeout, "Wall-clock limit of a single analysis, 0 for unlimited")
+	maxRepoSizeMB := flag.Int64("max-repo-size", maxRepoSize>>20, "Largest repo to analyze in MB, 0 for unlimited")
+	flag.IntVar(&maxRepoFiles, "max-files", maxRepoFiles, "Largest number of files to blame, 0 for unlimited")
+	maxFileSizeKB := flag.Int64("max-file-size", maxFileSize>>10, "Larger files are skipped, in KB, 0 for unlimited")
+	workerURLs := flag.String("workers", defaultWorkers(), "Comma-separated worker URLs")
+	pngInput := flag.String("png", "", "Convert an SVG saved to frontend/svgs to PNG and exit")
+	pngOutput := flag.String("png-out", "", "PNG path, the SVG path with .png extension by default")
+	pngScale := flag.Float64("png-scale", 1, "Scale of the PNG")
 
 	flag.Parse()
+	reposDiskBudget = *reposBudgetMB << 20
+	maxRepoSize = *maxRepoSizeMB << 20
+	maxFileSize = *maxFileSizeKB << 10
+	if err := ConfigureHosts(*hosts); err != nil {
+		log.WithError(err).Fatal("Bad -hosts")
+	}
+	githubClient.SetTokens(strings.Split(*githubTokens, ","))
+	if *aliases != "" {
+		if err := LoadAliases(*aliases); err != nil {
+			log.WithError(err).Fatal("Can't load -aliases")
+		}
+	}
+
+	if *pngInput != "" {
+		if err := svgFileToPNG(*pngInput, *pngOutput, *pngScale); err != nil {
+			log.WithError(err).Fatal("Can't convert to PNG")
+		}
+		return
+	}
 
 	if *worker {
 		fmt.Println("Running in worker mode")
-		workerHandler()
+		workerDBConnect()
+		workerNode = *advertise
+		if workerNode == "" {
+			workerNode = "127.0.0.1" + *listen
+		}
+		workerNode = normalizeWorkerURL(workerNode)
+		if err := os.MkdirAll(reposDir, 0777); err != nil {
+			log.WithError(err).Fatal("Can't create -repos-dir")
+		}
+		if *register != "" {
+			if registerSecret == "" {
+				log.Fatal("-register needs -register-secret")
+			}
+			go heartbeatLoop(*register, workerNode)
+		}
+		workerHandler(*listen)
 		return
 	}
 	dbConnect()
+	workers.AddStatic(strings.Split(*workerURLs, ","))
+	go workers.healthLoop()
 	go tokensFetchLoop()
 	r := gin.Default()
 	r.GET("/ping", func(c *gin.Context) {
@@ -224,17 +538,35 @@ func main() {
 	//	r.GET("cube.svg", drawCanvas)
 
 	r.POST("/check", func(c *gin.Context) {
-		repoURL := "https://github.com/" + c.PostForm("repo")
-		rc := RepoConfig{URL: repoURL}
+		repoURL, err := repoURLFromInput(c.PostForm("repo"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "error": err.Error()})
+			return
+		}
+		rc := RepoConfig{URL: repoURL, Ref: c.PostForm("ref"), AsOf: c.PostForm("asof")}
 		rs := rc.Repo().getCachedStat()
 
+		if c.PostForm("refresh") != "" {
+			repoQuery(rc, true)
+			c.JSON(200, gin.H{"status": "processing"})
+			return
+		}
+
 		if rs == nil {
-			repoQuery(repoURL)
+			if p, err := workerProgress(rc.Hash()); err == nil && p != nil && p.State == JobFailed {
+				dropPending(rc.Hash())
+				c.JSON(200, gin.H{"status": "failed", "error": p.Error})
+				return
+			}
+			repoQuery(rc, false)
 			c.JSON(200, gin.H{"status": "processing"})
 			return
 		}
-		if len(rs.Users) > 30 {
-			rs.Users = rs.Users[0:50]
+		// the page doesn't show the tree, it's available through /api/v1
+		rs.Tree = nil
+		rs.CodeOwners = ""
+		if len(rs.Users) > CHECK_MAX_USERS {
+			rs.Users = rs.Users[:CHECK_MAX_USERS]
 		}
 		//		rs.CodeLines.Total
 		c.JSON(200, gin.H{"status": "ready", "hash": rc.Hash(), "stat": rs})
@@ -258,11 +590,15 @@ func main() {
 	r.Static("/static", "./frontend")
 	r.StaticFile("/", "./frontend/index.html")
 	r.GET("/draw", drawRepoHandler)
+	r.GET("/draw.png", drawPNGHandler)
+	r.GET("/progress", progressHandler)
+	apiRoutes(r)
+	r.POST("/register", registerHandler)
 
 	r.GET("/rs", func(c *gin.Context) {
 		url, _ := c.GetQuery("url")
-		r := RepoConfig{URL: url}
-		rs, err := r.Stat()
+		r := RepoConfig{URL: url, Ref: c.Query("ref"), AsOf: c.Query("asof")}
+		rs, err := r.Stat(c.Request.Context(), nil)
 		if err != nil {
 			c.String(http.StatusBadRequest, err.Error())
 			return
@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		url               string
+		host, owner, name string
+	}{
+		{"https://github.com/Owner/Repo", "github.com", "owner", "repo"},
+		{"https://github.com/owner/repo.git", "github.com", "owner", "repo"},
+		{"https://github.com/owner/repo/", "github.com", "owner", "repo"},
+		{"https://git.example.com:8443/owner/repo", "git.example.com", "owner", "repo"},
+		{"ssh://git@git.example.com:2222/owner/repo.git", "git.example.com", "owner", "repo"},
+		{"git@gitlab.com:Group/Repo.git", "gitlab.com", "group", "repo"},
+		{"https://gitlab.com/group/sub/repo", "gitlab.com", "group/sub", "repo"},
+		{"git@gitlab.com:group/sub/deeper/repo.git", "gitlab.com", "group/sub/deeper", "repo"},
+	}
+	for _, tt := range tests {
+		rc := RepoConfig{URL: tt.url}
+		host, owner, name, err := rc.ParseURL()
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if host != tt.host || owner != tt.owner || name != tt.name {
+			t.Errorf("%s: got %s %s %s, want %s %s %s", tt.url, host, owner, name, tt.host, tt.owner, tt.name)
+		}
+	}
+}
+
+func TestParseURLErrors(t *testing.T) {
+	for _, u := range []string{
+		"",
+		"git@host:repo",
+		"git@host:",
+		"https://github.com/repo",
+		"https://github.com/",
+		"https://github.com/owner/.git",
+		"https://github.com/../../etc",
+		"http://github.com/owner/repo",
+		"file:///tmp/owner/repo",
+		"ext::sh -c touch% /tmp/pwned",
+		"/tmp/owner/repo",
+		"-uhelp",
+		"--upload-pack=touch /tmp/pwned",
+		"user@host:owner/repo",
+		"git@-oProxyCommand=x:owner/repo",
+		"ssh://-oProxyCommand=x/owner/repo",
+	} {
+		rc := RepoConfig{URL: u}
+		if _, _, _, err := rc.ParseURL(); err == nil {
+			t.Errorf("%q: no error", u)
+		}
+	}
+}
+
+func TestRepoURLFromInput(t *testing.T) {
+	tests := []struct {
+		input, url string
+	}{
+		{"owner/repo", "https://github.com/owner/repo"},
+		{" owner/repo ", "https://github.com/owner/repo"},
+		{"gitlab.com:group/sub/repo", "https://gitlab.com/group/sub/repo"},
+		{"https://gitea.com/owner/repo", "https://gitea.com/owner/repo"},
+		{"git@gitlab.com:owner/repo.git", "git@gitlab.com:owner/repo.git"},
+	}
+	for _, tt := range tests {
+		got, err := repoURLFromInput(tt.input)
+		if err != nil || got != tt.url {
+			t.Errorf("%q: got %q, %v, want %q", tt.input, got, err, tt.url)
+		}
+	}
+
+	for _, input := range []string{"-owner/repo", "--upload-pack=x", "file:///etc/passwd", "ext::sh", "http://github.com/owner/repo", "gitlab.com:repo"} {
+		if _, err := repoURLFromInput(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
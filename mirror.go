@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// touched after every successful clone or fetch
+const MIRROR_FETCHED_FILE = "gitfluence-fetched"
+
+// touched every time the mirror is used, for LRU eviction
+const MIRROR_USED_FILE = "gitfluence-used"
+
+// mirrors older than that are fetched before use
+var mirrorMaxAge = time.Hour
+
+// reposDir size limit in bytes, 0 means unlimited
+var reposDiskBudget int64 = 10 << 30
+
+// refuses local and ext:: transports for remotes given by users
+var gitRemoteConfig = []string{"-c", "protocol.file.allow=never", "-c", "protocol.ext.allow=never"}
+
+// gitRemoteCommand runs git talking to a remote given by a user
+func gitRemoteCommand(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, "git", append(append([]string{}, gitRemoteConfig...), args...)...)
+}
+
+func (repo RepoConfig) mirrorPath() (string, error) {
+	host, owner, name, err := repo.ParseURL()
+	if err != nil {
+		return "", permanentError("Bad repo URL %q: %v", repo.URL, err)
+	}
+	// GitLab subgroups are kept in one directory level, mirrors are always reposDir/host/owner/name
+	return reposDir + "/" + host + "/" + url.PathEscape(owner) + "/" + name, nil
+}
+
+// GitClone returns the path of an up to date mirror of the repo, cloning it if needed
+func (repo RepoConfig) GitClone(ctx context.Context) (string, error) {
+	repoDst, err := repo.mirrorPath()
+	if err != nil {
+		return "", err
+	}
+
+	if exists(repoDst) && !mirrorIsValid(repoDst) {
+		log.WithField("path", repoDst).Warn("Mirror is corrupted, cloning again")
+		if err = os.RemoveAll(repoDst); err != nil {
+			return "", err
+		}
+	}
+
+	if exists(repoDst) {
+		if mirrorAge(repoDst) > mirrorMaxAge {
+			if err = mirrorFetch(ctx, repoDst); err != nil {
+				return "", err
+			}
+		}
+	} else {
+		// clone into a temporary dir, so a crash never leaves a half-cloned mirror in place
+		tmpDst := repoDst + ".tmp"
+		os.RemoveAll(tmpDst)
+		os.MkdirAll(filepath.Dir(repoDst), 0777)
+
+		cloneCtx, cancelClone := context.WithCancel(ctx)
+		stderr := bytes.Buffer{}
+		cmd := gitRemoteCommand(cloneCtx, "clone", "--", repo.URL, tmpDst)
+		// private repos fail instead of waiting for credentials
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+		tooLarge := watchCloneSize(cloneCtx, tmpDst, cancelClone)
+		_, err := cmd.Output()
+		cancelClone()
+		if sizeErr := tooLarge(); sizeErr != nil {
+			os.RemoveAll(tmpDst)
+			return "", sizeErr
+		}
+		if err != nil {
+			os.RemoveAll(tmpDst)
+			return "", gitError("clone", err, &stderr)
+		}
+		if err = os.Rename(tmpDst, repoDst); err != nil {
+			os.RemoveAll(tmpDst)
+			return "", err
+		}
+		touchMirrorFile(repoDst, MIRROR_FETCHED_FILE)
+	}
+
+	touchMirrorFile(repoDst, MIRROR_USED_FILE)
+	evictMirrors(repoDst)
+
+	return repoDst, nil
+}
+
+// ExpireMirror makes the next GitClone fetch the repo regardless of the mirror age
+func (repo RepoConfig) ExpireMirror() {
+	repoDst, err := repo.mirrorPath()
+	if err != nil {
+		return
+	}
+	os.Remove(filepath.Join(repoDst, ".git", MIRROR_FETCHED_FILE))
+}
+
+func mirrorIsValid(repoPath string) bool {
+	cmd := exec.Command("git", "rev-parse", "--verify", "HEAD")
+	cmd.Dir = repoPath
+	return cmd.Run() == nil
+}
+
+// mirrorFetch fetches the remote and resets the working tree to the remote default branch
+func mirrorFetch(ctx context.Context, repoPath string) error {
+	for _, args := range [][]string{
+		{"fetch", "--prune", "origin"},
+		{"remote", "set-head", "origin", "--auto"},
+		{"reset", "--hard", "origin/HEAD"},
+	} {
+		stderr := bytes.Buffer{}
+		cmd := gitRemoteCommand(ctx, args...)
+		cmd.Dir = repoPath
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+		if _, err := cmd.Output(); err != nil {
+			return gitError(args[0], err, &stderr)
+		}
+	}
+	touchMirrorFile(repoPath, MIRROR_FETCHED_FILE)
+	return nil
+}
+
+func touchMirrorFile(repoPath, name string) {
+	if err := ioutil.WriteFile(filepath.Join(repoPath, ".git", name), nil, 0666); err != nil {
+		log.WithError(err).WithField("path", repoPath).Error("Can't touch " + name)
+	}
+}
+
+func mirrorFileTime(repoPath, name string) time.Time {
+	s, err := os.Stat(filepath.Join(repoPath, ".git", name))
+	if err != nil {
+		return time.Time{}
+	}
+	return s.ModTime()
+}
+
+func mirrorAge(repoPath string) time.Duration {
+	return time.Since(mirrorFileTime(repoPath, MIRROR_FETCHED_FILE))
+}
+
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+type mirrorInfo struct {
+	Path     string
+	Size     int64
+	LastUsed time.Time
+}
+
+type ByLastUsed []mirrorInfo
+
+func (a ByLastUsed) Len() int      { return len(a) }
+func (a ByLastUsed) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByLastUsed) Less(i, j int) bool {
+	return a[i].LastUsed.Before(a[j].LastUsed)
+}
+
+// evictMirrors removes least recently used mirrors until reposDir fits into the disk budget
+func evictMirrors(keep string) {
+	if reposDiskBudget <= 0 {
+		return
+	}
+	paths, err := filepath.Glob(reposDir + "/*/*/*")
+	if err != nil {
+		return
+	}
+
+	var mirrors []mirrorInfo
+	var total int64
+	for _, p := range paths {
+		if !isDir(p) {
+			continue
+		}
+		m := mirrorInfo{Path: p, Size: dirSize(p), LastUsed: mirrorFileTime(p, MIRROR_USED_FILE)}
+		total += m.Size
+		// clones in progress use the disk too, but removing them would break the clone
+		if p != keep && !strings.HasSuffix(p, ".tmp") {
+			mirrors = append(mirrors, m)
+		}
+	}
+
+	sort.Sort(ByLastUsed(mirrors))
+	for _, m := range mirrors {
+		if total <= reposDiskBudget {
+			break
+		}
+		log.WithField("path", m.Path).WithField("size", m.Size).Info("Evicting mirror")
+		if err := os.RemoveAll(m.Path); err != nil {
+			log.WithError(err).WithField("path", m.Path).Error("Can't evict mirror")
+			continue
+		}
+		total -= m.Size
+	}
+}
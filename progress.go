@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// JobProgress is what the worker knows about a job, served by /progress
+type JobProgress struct {
+	Hash       string
+	State      JobState
+	Files      int // files blamed so far
+	TotalFiles int
+	ETA        int    // seconds left, 0 if unknown
+	Attempts   int    // including the running one
+	Error      string `json:",omitempty"` // reason of the failure or of the last retry
+}
+
+type runningJob struct {
+	progress     JobProgress
+	cancel       context.CancelFunc
+	blameStarted time.Time
+	// files taken from the blame cache, they don't count for the ETA
+	cachedFiles int
+}
+
+// progress of the jobs running on this worker. It changes on every file, so it isn't written to the job store
+type progressTracker struct {
+	mu   sync.Mutex
+	jobs map[string]*runningJob
+}
+
+var running = &progressTracker{jobs: make(map[string]*runningJob)}
+
+func (t *progressTracker) start(job *Job, cancel context.CancelFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.jobs[job.Hash] = &runningJob{progress: JobProgress{Hash: job.Hash, State: JobCloning, Attempts: job.Attempts, Error: job.Error}, cancel: cancel}
+}
+
+// cancel stops the job if it's running on this worker
+func (t *progressTracker) cancel(hash string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j, exists := t.jobs[hash]
+	if !exists {
+		return false
+	}
+	j.cancel()
+	return true
+}
+
+func (t *progressTracker) finish(hash string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.jobs, hash)
+}
+
+func (t *progressTracker) phase(hash string, state JobState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if j, exists := t.jobs[hash]; exists {
+		j.progress.State = state
+	}
+}
+
+func (t *progressTracker) files(hash string, files, totalFiles int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j, exists := t.jobs[hash]
+	if !exists {
+		return
+	}
+	if j.blameStarted.IsZero() {
+		j.blameStarted = time.Now()
+		j.cachedFiles = files
+	}
+	j.progress.Files = files
+	j.progress.TotalFiles = totalFiles
+
+	// blame time per file is assumed to be the same for the rest of the files
+	j.progress.ETA = 0
+	if blamed := files - j.cachedFiles; blamed > 0 {
+		perFile := time.Since(j.blameStarted) / time.Duration(blamed)
+		j.progress.ETA = int((perFile * time.Duration(totalFiles-files)).Seconds())
+	}
+}
+
+// Get returns the progress of a job running on this worker
+func (t *progressTracker) Get(hash string) (JobProgress, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	j, exists := t.jobs[hash]
+	if !exists {
+		return JobProgress{}, false
+	}
+	return j.progress, true
+}
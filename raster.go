@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// scanlines sampled per pixel row, they anti-alias the edges
+const RASTER_SUBSAMPLES = 4
+
+// circles are drawn as polygons of that many sides
+const RASTER_CIRCLE_SEGMENTS = 64
+
+const RASTER_MAX_SCALE = 4
+
+// text without font-size, SVG's default
+const RASTER_FONT_SIZE = 16
+
+// the bitmap font has ASCII only, other characters the labels use are drawn as their look-alikes
+var rasterTextReplacer = strings.NewReplacer("·", "-")
+
+type rasterPoint struct {
+	X float64
+	Y float64
+}
+
+// Rasterizer fills flat-colored shapes on a white image, edges are anti-aliased by coverage
+type Rasterizer struct {
+	img *image.RGBA
+	cov []float64
+}
+
+func NewRasterizer(width, height int) *Rasterizer {
+	r := Rasterizer{img: image.NewRGBA(image.Rect(0, 0, width, height)), cov: make([]float64, width+1)}
+	for i := range r.img.Pix {
+		r.img.Pix[i] = 0xff
+	}
+	return &r
+}
+
+func (r *Rasterizer) Image() *image.RGBA {
+	return r.img
+}
+
+// addSpan covers [x0, x1) of the row by weight, partially covered pixels get their share
+func (r *Rasterizer) addSpan(x0, x1, weight float64) {
+	w := float64(r.img.Rect.Dx())
+	x0 = math.Max(x0, 0)
+	x1 = math.Min(x1, w)
+	if x0 >= x1 {
+		return
+	}
+	i0, i1 := int(x0), int(x1)
+	if i0 == i1 {
+		r.cov[i0] += (x1 - x0) * weight
+		return
+	}
+	r.cov[i0] += (float64(i0+1) - x0) * weight
+	for i := i0 + 1; i < i1; i++ {
+		r.cov[i] += weight
+	}
+	r.cov[i1] += (x1 - float64(i1)) * weight
+}
+
+// Fill paints the rings with the even-odd rule, so a ring inside another one makes a hole
+func (r *Rasterizer) Fill(rings [][]rasterPoint, c color.RGBA) {
+	minX, maxX := math.Inf(1), math.Inf(-1)
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	for _, ring := range rings {
+		for _, p := range ring {
+			minX, maxX = math.Min(minX, p.X), math.Max(maxX, p.X)
+			minY, maxY = math.Min(minY, p.Y), math.Max(maxY, p.Y)
+		}
+	}
+	x0 := int(math.Max(math.Floor(minX), 0))
+	x1 := int(math.Min(math.Ceil(maxX), float64(r.img.Rect.Dx())))
+	y0 := int(math.Max(math.Floor(minY), 0))
+	y1 := int(math.Min(math.Ceil(maxY), float64(r.img.Rect.Dy())))
+
+	var xs []float64
+	for y := y0; y < y1; y++ {
+		for s := 0; s < RASTER_SUBSAMPLES; s++ {
+			sy := float64(y) + (float64(s)+0.5)/RASTER_SUBSAMPLES
+			xs = xs[:0]
+			for _, ring := range rings {
+				for i := range ring {
+					a, b := ring[i], ring[(i+1)%len(ring)]
+					if (a.Y <= sy && b.Y > sy) || (b.Y <= sy && a.Y > sy) {
+						xs = append(xs, a.X+(sy-a.Y)*(b.X-a.X)/(b.Y-a.Y))
+					}
+				}
+			}
+			sort.Float64s(xs)
+			for i := 0; i+1 < len(xs); i += 2 {
+				r.addSpan(xs[i], xs[i+1], 1.0/RASTER_SUBSAMPLES)
+			}
+		}
+		r.blendRow(y, x0, x1, c)
+	}
+}
+
+// blendRow paints the covered pixels of the row from x0 to x1 and clears the coverage
+func (r *Rasterizer) blendRow(y, x0, x1 int, c color.RGBA) {
+	for x := x0; x <= x1; x++ {
+		a := math.Min(r.cov[x], 1)
+		r.cov[x] = 0
+		if a <= 0 || x == r.img.Rect.Dx() {
+			continue
+		}
+		i := r.img.PixOffset(x, y)
+		for j, v := range []uint8{c.R, c.G, c.B} {
+			r.img.Pix[i+j] = uint8(math.Floor(float64(r.img.Pix[i+j])*(1-a) + float64(v)*a + 0.5))
+		}
+	}
+}
+
+// Text draws a line of text with the 7x13 bitmap font scaled to size, x and y are the start of the baseline
+// or its end or middle by anchor. Glyph pixels are filled as squares, so text scales like the shapes
+func (r *Rasterizer) Text(x, y, size float64, text, anchor string, bold bool, c color.RGBA) {
+	face := basicfont.Face7x13
+	text = rasterTextReplacer.Replace(text)
+	d := font.Drawer{Face: face, Src: image.Opaque}
+	width := d.MeasureString(text).Ceil()
+	if width == 0 {
+		return
+	}
+	if bold {
+		width++
+	}
+	mask := image.NewAlpha(image.Rect(0, 0, width, face.Height))
+	d.Dst = mask
+	d.Dot = fixed.P(0, face.Ascent)
+	d.DrawString(text)
+	if bold {
+		// the same glyphs a pixel to the right
+		d.Dot = fixed.P(1, face.Ascent)
+		d.DrawString(text)
+	}
+
+	k := size / float64(face.Height)
+	switch anchor {
+	case "end":
+		x -= float64(width) * k
+	case "middle":
+		x -= float64(width) * k / 2
+	}
+	top := y - float64(face.Ascent)*k
+
+	// a rectangle for every run of glyph pixels in a row, runs never overlap so even-odd fills them all
+	var rings [][]rasterPoint
+	for py := 0; py < face.Height; py++ {
+		y0, y1 := top+float64(py)*k, top+float64(py+1)*k
+		for px := 0; px < width; px++ {
+			if mask.AlphaAt(px, py).A == 0 {
+				continue
+			}
+			start := px
+			for px < width && mask.AlphaAt(px, py).A != 0 {
+				px++
+			}
+			x0, x1 := x+float64(start)*k, x+float64(px)*k
+			rings = append(rings, []rasterPoint{{x0, y0}, {x1, y0}, {x1, y1}, {x0, y1}})
+		}
+	}
+	if len(rings) > 0 {
+		r.Fill(rings, c)
+	}
+}
+
+func circleRing(cx, cy, radius float64) []rasterPoint {
+	ring := make([]rasterPoint, RASTER_CIRCLE_SEGMENTS)
+	for i := range ring {
+		a := 2 * math.Pi * float64(i) / RASTER_CIRCLE_SEGMENTS
+		ring[i] = rasterPoint{cx + radius*math.Cos(a), cy + radius*math.Sin(a)}
+	}
+	return ring
+}
+
+// parseStyle splits "fill:rgb(1,2,3);stroke-width:3" into properties
+func parseStyle(style string) map[string]string {
+	props := make(map[string]string)
+	for _, decl := range strings.Split(style, ";") {
+		if kv := strings.SplitN(decl, ":", 2); len(kv) == 2 {
+			props[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return props
+}
+
+// parseRGB reads "rgb(1,2,3)", other colors aren't emitted by Draw
+func parseRGB(value string) (color.RGBA, bool) {
+	if !strings.HasPrefix(value, "rgb(") || !strings.HasSuffix(value, ")") {
+		return color.RGBA{}, false
+	}
+	f := strings.Split(value[4:len(value)-1], ",")
+	if len(f) != 3 {
+		return color.RGBA{}, false
+	}
+	c := color.RGBA{A: 0xff}
+	for i, dst := range []*uint8{&c.R, &c.G, &c.B} {
+		v, err := strconv.Atoi(strings.TrimSpace(f[i]))
+		if err != nil || v < 0 || v > 255 {
+			return color.RGBA{}, false
+		}
+		*dst = uint8(v)
+	}
+	return c, true
+}
+
+func xmlAttrs(e xml.StartElement) map[string]string {
+	attrs := make(map[string]string)
+	for _, a := range e.Attr {
+		attrs[a.Name.Local] = a.Value
+	}
+	return attrs
+}
+
+// elementText returns the character data up to the end of the element the decoder is in
+func elementText(d *xml.Decoder) (string, error) {
+	text := bytes.Buffer{}
+	for depth := 1; depth > 0; {
+		token, err := d.Token()
+		if err != nil {
+			return "", err
+		}
+		switch t := token.(type) {
+		case xml.CharData:
+			text.Write(t)
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return text.String(), nil
+}
+
+func attrFloat(attrs map[string]string, name string) float64 {
+	v, _ := strconv.ParseFloat(attrs[name], 64)
+	return v
+}
+
+// RasterizeSVG draws the polygons, rectangles, circles and text of an image made by Draw, scaled.
+// Text is drawn with a bitmap font, whatever the font family is
+func RasterizeSVG(in io.Reader, scale float64) (*image.RGBA, error) {
+	if scale <= 0 || scale > RASTER_MAX_SCALE {
+		return nil, errors.New("Bad scale " + strconv.FormatFloat(scale, 'g', -1, 64))
+	}
+	var r *Rasterizer
+	d := xml.NewDecoder(in)
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		e, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		attrs := xmlAttrs(e)
+		if e.Name.Local == "svg" {
+			r = NewRasterizer(int(math.Ceil(attrFloat(attrs, "width")*scale)), int(math.Ceil(attrFloat(attrs, "height")*scale)))
+			continue
+		}
+		if r == nil {
+			continue
+		}
+
+		style := parseStyle(attrs["style"])
+		fill, hasFill := parseRGB(style["fill"])
+		switch e.Name.Local {
+		case "polygon":
+			var ring []rasterPoint
+			for _, pair := range strings.Fields(attrs["points"]) {
+				xy := strings.Split(pair, ",")
+				if len(xy) != 2 {
+					continue
+				}
+				x, _ := strconv.ParseFloat(xy[0], 64)
+				y, _ := strconv.ParseFloat(xy[1], 64)
+				ring = append(ring, rasterPoint{x * scale, y * scale})
+			}
+			if hasFill && len(ring) > 2 {
+				r.Fill([][]rasterPoint{ring}, fill)
+			}
+		case "rect":
+			x, y := attrFloat(attrs, "x")*scale, attrFloat(attrs, "y")*scale
+			w, h := attrFloat(attrs, "width")*scale, attrFloat(attrs, "height")*scale
+			if hasFill {
+				r.Fill([][]rasterPoint{{{x, y}, {x + w, y}, {x + w, y + h}, {x, y + h}}}, fill)
+			}
+		case "circle":
+			cx, cy, radius := attrFloat(attrs, "cx")*scale, attrFloat(attrs, "cy")*scale, attrFloat(attrs, "r")*scale
+			if hasFill {
+				r.Fill([][]rasterPoint{circleRing(cx, cy, radius)}, fill)
+			}
+			if stroke, hasStroke := parseRGB(style["stroke"]); hasStroke {
+				width, err := strconv.ParseFloat(style["stroke-width"], 64)
+				if err != nil {
+					width = 1
+				}
+				width *= scale
+				r.Fill([][]rasterPoint{circleRing(cx, cy, radius+width/2), circleRing(cx, cy, math.Max(radius-width/2, 0))}, stroke)
+			}
+		case "text":
+			text, err := elementText(d)
+			if err != nil {
+				return nil, err
+			}
+			size, err := strconv.ParseFloat(strings.TrimSuffix(style["font-size"], "px"), 64)
+			if err != nil {
+				size = RASTER_FONT_SIZE
+			}
+			if !hasFill {
+				fill = color.RGBA{A: 0xff}
+			}
+			r.Text(attrFloat(attrs, "x")*scale, attrFloat(attrs, "y")*scale, size*scale, text, style["text-anchor"], style["font-weight"] == "bold", fill)
+		}
+	}
+	if r == nil {
+		return nil, errors.New("No <svg> element")
+	}
+	return r.Image(), nil
+}
+
+// svgFileToPNG converts an image saved by Draw, the PNG is written next to it if out is empty
+func svgFileToPNG(in, out string, scale float64) error {
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	img, err := RasterizeSVG(f, scale)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		out = strings.TrimSuffix(in, ".svg") + ".png"
+	}
+	o, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err = png.Encode(o, img); err != nil {
+		o.Close()
+		return err
+	}
+	return o.Close()
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+var updateGolden = flag.Bool("update", false, "write the golden images of the tests")
+
+// channel difference allowed per pixel, antialiasing may differ a little between platforms
+const GOLDEN_TOLERANCE = 8
+
+func goldenStat() *RepoStat {
+	lines := func(n int) LinesStat {
+		return LinesStat{Total: n, Months: map[string]int{"2020-01": n}}
+	}
+	rs := &RepoStat{
+		Commit:     "0123456789abcdef",
+		CommitTime: time.Date(2020, 1, 15, 0, 0, 0, 0, time.UTC),
+		CodeLines:  lines(6000),
+		DocLines:   lines(900),
+		TestLines:  lines(1500),
+		Resources:  lines(300),
+	}
+	for i, u := range []struct {
+		email, username string
+		code, docs      int
+		color           Color
+	}{
+		{"alice@example.com", "alice", 3500, 600, Color{200, 60, 60}},
+		{"bob@example.com", "bob", 2000, 300, Color{60, 140, 200}},
+		{"carol@example.com", "", 500, 0, Color{90, 180, 90}},
+	} {
+		rs.Users = append(rs.Users, &UserStat{
+			Email:     u.email,
+			Username:  u.username,
+			CodeLines: lines(u.code),
+			DocLines:  lines(u.docs),
+			TestLines: lines(500 * (i + 1) / 2),
+			Resources: lines(100 * i),
+			Color:     u.color,
+		})
+	}
+	return rs
+}
+
+// TestDrawStatGolden guards the whole drawing against unintended changes, the golden image is written by the
+// rasterizer itself with -update. Rasterizer correctness is tested against known pixels below
+func TestDrawStatGolden(t *testing.T) {
+	repo := &Repo{Hash: "golden", Host: "github.com", Owner: "owner", Name: "repo"}
+	svg := bytes.Buffer{}
+	repo.DrawStat(&svg, goldenStat(), DrawOptions{Seed: 1, Legend: true})
+	img, err := RasterizeSVG(&svg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := "testdata/drawstat.png"
+	if *updateGolden {
+		buf := bytes.Buffer{}
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(golden, buf.Bytes(), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.Bounds() != want.Bounds() {
+		t.Fatalf("got %v image, want %v", img.Bounds(), want.Bounds())
+	}
+	differ := 0
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			if !colorsClose(img, want, x, y) {
+				differ++
+			}
+		}
+	}
+	if differ > 0 {
+		t.Errorf("%d pixels differ from %s, run the test with -update if the change is intended", differ, golden)
+	}
+}
+
+func colorsClose(a, b image.Image, x, y int) bool {
+	r1, g1, b1, a1 := a.At(x, y).RGBA()
+	r2, g2, b2, a2 := b.At(x, y).RGBA()
+	for _, d := range []int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8), int(a1>>8) - int(a2>>8)} {
+		if d > GOLDEN_TOLERANCE || d < -GOLDEN_TOLERANCE {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	rasterWhite = color.RGBA{255, 255, 255, 255}
+	rasterRed   = color.RGBA{255, 0, 0, 255}
+	// rasterRed covering half of a white pixel
+	rasterHalfRed = color.RGBA{255, 128, 128, 255}
+)
+
+func rasterTestSVG(width, height int, body string) string {
+	return fmt.Sprintf(`<svg width="%d" height="%d">%s</svg>`, width, height, body)
+}
+
+// checkPixels compares the image with the expected colors of the listed pixels, and of all other pixels if rest is set.
+// A difference of one is allowed for rounding
+func checkPixels(t *testing.T, name string, img *image.RGBA, want map[image.Point]color.RGBA, rest *color.RGBA) {
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			w, listed := want[image.Pt(x, y)]
+			if !listed {
+				if rest == nil {
+					continue
+				}
+				w = *rest
+			}
+			got := img.RGBAAt(x, y)
+			for _, d := range []int{int(got.R) - int(w.R), int(got.G) - int(w.G), int(got.B) - int(w.B)} {
+				if d > 1 || d < -1 {
+					t.Errorf("%s: pixel %d,%d is %v, want %v", name, x, y, got, w)
+					break
+				}
+			}
+		}
+	}
+}
+
+// rectPixels lists the pixels of the rectangle with the color
+func rectPixels(want map[image.Point]color.RGBA, r image.Rectangle, c color.RGBA) map[image.Point]color.RGBA {
+	if want == nil {
+		want = make(map[image.Point]color.RGBA)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			want[image.Pt(x, y)] = c
+		}
+	}
+	return want
+}
+
+func TestRasterizeShapes(t *testing.T) {
+	tests := []struct {
+		name   string
+		svg    string
+		scale  float64
+		width  int
+		height int
+		want   map[image.Point]color.RGBA // all other pixels are white
+	}{
+		{
+			"rect on the pixel grid",
+			rasterTestSVG(10, 10, `<rect x="2" y="3" width="4" height="2" style="fill:rgb(255,0,0)"/>`),
+			1, 10, 10,
+			rectPixels(nil, image.Rect(2, 3, 6, 5), rasterRed),
+		},
+		{
+			"rect edges halfway through pixels",
+			rasterTestSVG(6, 6, `<rect x="1.5" y="1.5" width="2" height="2" style="fill:rgb(255,0,0)"/>`),
+			1, 6, 6,
+			map[image.Point]color.RGBA{
+				{1, 1}: {255, 191, 191, 255}, {2, 1}: rasterHalfRed, {3, 1}: {255, 191, 191, 255},
+				{1, 2}: rasterHalfRed, {2, 2}: rasterRed, {3, 2}: rasterHalfRed,
+				{1, 3}: {255, 191, 191, 255}, {2, 3}: rasterHalfRed, {3, 3}: {255, 191, 191, 255},
+			},
+		},
+		{
+			"triangle with a diagonal edge",
+			rasterTestSVG(4, 4, `<polygon points="0,0 4,0 0,4" style="fill:rgb(255,0,0)"/>`),
+			1, 4, 4,
+			// pixels below the diagonal are white, the ones it crosses are half covered
+			map[image.Point]color.RGBA{
+				{0, 0}: rasterRed, {1, 0}: rasterRed, {2, 0}: rasterRed, {3, 0}: rasterHalfRed,
+				{0, 1}: rasterRed, {1, 1}: rasterRed, {2, 1}: rasterHalfRed,
+				{0, 2}: rasterRed, {1, 2}: rasterHalfRed,
+				{0, 3}: rasterHalfRed,
+			},
+		},
+		{
+			"scaled",
+			rasterTestSVG(4, 3, `<rect x="1" y="1" width="2" height="1" style="fill:rgb(255,0,0)"/>`),
+			3, 12, 9,
+			rectPixels(nil, image.Rect(3, 3, 9, 6), rasterRed),
+		},
+		{
+			"clipped at the canvas edges",
+			rasterTestSVG(6, 6, `<rect x="-5" y="4" width="8" height="10" style="fill:rgb(255,0,0)"/>`+
+				`<polygon points="4,-3 9,-3 9,2 4,2" style="fill:rgb(255,0,0)"/>`+
+				`<rect x="20" y="20" width="5" height="5" style="fill:rgb(0,0,0)"/>`),
+			1, 6, 6,
+			rectPixels(rectPixels(nil, image.Rect(0, 4, 3, 6), rasterRed), image.Rect(4, 0, 6, 2), rasterRed),
+		},
+		{
+			"shapes without fill",
+			rasterTestSVG(4, 4, `<rect x="0" y="0" width="4" height="4" style="stroke:rgb(255,0,0)"/>`),
+			1, 4, 4,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		img, err := RasterizeSVG(strings.NewReader(tt.svg), tt.scale)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if img.Bounds().Dx() != tt.width || img.Bounds().Dy() != tt.height {
+			t.Errorf("%s: got %v image, want %dx%d", tt.name, img.Bounds(), tt.width, tt.height)
+			continue
+		}
+		checkPixels(t, tt.name, img, tt.want, &rasterWhite)
+	}
+}
+
+func TestRasterizerEvenOdd(t *testing.T) {
+	r := NewRasterizer(10, 10)
+	square := func(x0, y0, x1, y1 float64) []rasterPoint {
+		return []rasterPoint{{x0, y0}, {x1, y0}, {x1, y1}, {x0, y1}}
+	}
+	// the inner square is a hole, the innermost one is filled again
+	r.Fill([][]rasterPoint{square(1, 1, 9, 9), square(3, 3, 7, 7), square(4, 4, 6, 6)}, rasterRed)
+
+	want := rectPixels(nil, image.Rect(1, 1, 9, 9), rasterRed)
+	rectPixels(want, image.Rect(3, 3, 7, 7), rasterWhite)
+	rectPixels(want, image.Rect(4, 4, 6, 6), rasterRed)
+	checkPixels(t, "nested squares", r.Image(), want, &rasterWhite)
+
+	// a stroked circle has a hole of the radius less half the stroke
+	img, err := RasterizeSVG(strings.NewReader(rasterTestSVG(40, 40, `<circle cx="20" cy="20" r="15" style="fill:none;stroke:rgb(255,0,0);stroke-width:4"/>`)), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPixels(t, "stroked circle", img, map[image.Point]color.RGBA{
+		{20, 20}: rasterWhite, {19, 19}: rasterWhite, {20, 8}: rasterWhite, {20, 2}: rasterWhite,
+		{20, 4}: rasterRed, {20, 5}: rasterRed, {20, 35}: rasterRed, {4, 20}: rasterRed, {35, 20}: rasterRed,
+	}, nil)
+}
+
+// at 13px and scale 1 the glyphs are the font's own pixels
+func TestRasterizeText(t *testing.T) {
+	img, err := RasterizeSVG(strings.NewReader(rasterTestSVG(40, 16, `<text x="3" y="12" style="font-size:13px;fill:rgb(255,0,0)">Hi!</text>`)), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := image.NewRGBA(img.Bounds())
+	draw.Draw(want, want.Bounds(), image.NewUniform(rasterWhite), image.ZP, draw.Src)
+	d := font.Drawer{Dst: want, Src: image.NewUniform(rasterRed), Face: basicfont.Face7x13, Dot: fixed.P(3, 12)}
+	d.DrawString("Hi!")
+
+	pixels := make(map[image.Point]color.RGBA)
+	for y := 0; y < want.Bounds().Dy(); y++ {
+		for x := 0; x < want.Bounds().Dx(); x++ {
+			pixels[image.Pt(x, y)] = want.RGBAAt(x, y)
+		}
+	}
+	checkPixels(t, "text", img, pixels, nil)
+
+	// anchored at the end the text ends at x
+	img, err = RasterizeSVG(strings.NewReader(rasterTestSVG(40, 16, `<text x="24" y="12" style="font-size:13px;fill:rgb(255,0,0);text-anchor:end">Hi!</text>`)), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPixels(t, "text anchored at the end", img, pixels, nil)
+}
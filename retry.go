@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// temporary failures are retried that many times before the job fails
+const JOB_MAX_ATTEMPTS = 5
+
+// delay before the first retry, doubled after every attempt
+const JOB_RETRY_BASE = 30 * time.Second
+const JOB_RETRY_MAX = 30 * time.Minute
+
+// JobError is a failure with a known cause. Temporary ones are retried with backoff
+type JobError struct {
+	Reason    string
+	Temporary bool
+}
+
+func (e *JobError) Error() string {
+	return e.Reason
+}
+
+func permanentError(format string, args ...interface{}) error {
+	return &JobError{Reason: fmt.Sprintf(format, args...)}
+}
+
+func temporaryError(format string, args ...interface{}) error {
+	return &JobError{Reason: fmt.Sprintf(format, args...), Temporary: true}
+}
+
+// isTemporary reports whether the job may succeed on retry. Unclassified errors are retried,
+// the number of attempts is limited anyway
+func isTemporary(err error) bool {
+	if je, ok := err.(*JobError); ok {
+		return je.Temporary
+	}
+	return true
+}
+
+// retryDelay returns the backoff after the attempt, counted from 1
+func retryDelay(attempt int) time.Duration {
+	delay := JOB_RETRY_BASE
+	for i := 1; i < attempt && delay < JOB_RETRY_MAX; i++ {
+		delay *= 2
+	}
+	if delay > JOB_RETRY_MAX {
+		delay = JOB_RETRY_MAX
+	}
+	return delay
+}
+
+// git messages of failures which won't go away on retry
+var permanentGitErrors = []string{
+	"repository not found",
+	"the project you were looking for could not be found",
+	"does not appear to be a git repository",
+	"authentication failed",
+	"could not read username",
+	"terminal prompts disabled",
+	"invalid username or password",
+	"access denied",
+	"permission denied",
+}
+
+// git's own message for a missing repo on a http(s) remote, with the URL in the middle
+var repoNotFoundRegexp = regexp.MustCompile(`fatal: repository '[^']*' not found`)
+
+// gitError classifies a failed git command by its stderr
+func gitError(command string, err error, stderr *bytes.Buffer) error {
+	// progress lines like "Cloning into ..." don't explain anything
+	var lines []string
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		if strings.HasPrefix(line, "fatal: ") || strings.HasPrefix(line, "error: ") || strings.HasPrefix(line, "remote: ") {
+			lines = append(lines, line)
+		}
+	}
+	msg := strings.Join(lines, "; ")
+	if msg == "" {
+		msg = err.Error()
+	}
+	if repoNotFoundRegexp.MatchString(msg) {
+		return permanentError("git %s: %s", command, msg)
+	}
+	lower := strings.ToLower(msg)
+	for _, p := range permanentGitErrors {
+		if strings.Contains(lower, p) {
+			return permanentError("git %s: %s", command, msg)
+		}
+	}
+	return temporaryError("git %s: %s", command, msg)
+}
+
+// apiStatusError is an unexpected HTTP status from a git host API
+type apiStatusError struct {
+	Method string
+	Path   string
+	Status string
+	Code   int
+}
+
+func (e *apiStatusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.Path, e.Status)
+}
+
+// isServerError reports whether the API failed on its side, so the request may succeed later
+func isServerError(err error) bool {
+	e, ok := err.(*apiStatusError)
+	return ok && e.Code >= 500
+}
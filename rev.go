@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how much of the blob is read to detect binary and generated files
+const BLOB_HEAD_SIZE = 8192
+
+func gitRevParse(repoPath, rev string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", rev)
+	cmd.Dir = repoPath
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// commitTime returns the committer date of the commit
+func commitTime(repoPath, rev string) (time.Time, error) {
+	cmd := exec.Command("git", "log", "-n", "1", "--format=%ct", rev)
+	cmd.Dir = repoPath
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(t, 0), nil
+}
+
+// resolveRef returns the SHA of the branch, tag or commit in the mirror, or an empty string
+func resolveRef(repoPath, ref string) string {
+	// only the default branch is local in the mirror, others are remote-tracking
+	for _, candidate := range []string{ref, "origin/" + ref} {
+		if sha, err := gitRevParse(repoPath, candidate+"^{commit}"); err == nil {
+			return sha
+		}
+	}
+	return ""
+}
+
+// ResolveRev returns the SHA of the commit to analyze: HEAD, the configured ref
+// or the last commit before the "as of" date
+func (r *RepoConfig) ResolveRev(ctx context.Context, repoPath string) (string, error) {
+	rev := "HEAD"
+	if r.Ref != "" {
+		if strings.HasPrefix(r.Ref, "-") {
+			return "", permanentError("Bad ref: %s", r.Ref)
+		}
+		rev = resolveRef(repoPath, r.Ref)
+		if rev == "" {
+			// the ref may be newer than the mirror
+			if err := mirrorFetch(ctx, repoPath); err != nil {
+				return "", err
+			}
+			rev = resolveRef(repoPath, r.Ref)
+		}
+		if rev == "" {
+			return "", permanentError("Unknown ref: %s", r.Ref)
+		}
+	}
+
+	if r.AsOf != "" {
+		cmd := exec.Command("git", "rev-list", "-n", "1", "--first-parent", "--before="+r.AsOf, rev)
+		cmd.Dir = repoPath
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", permanentError("git rev-list: %v", err)
+		}
+		sha := strings.TrimSpace(string(out))
+		if sha == "" {
+			return "", permanentError("No commits before %s", r.AsOf)
+		}
+		return sha, nil
+	}
+
+	return gitRevParse(repoPath, rev+"^{commit}")
+}
+
+// readBlobHead returns up to n first bytes of the file at rev
+func readBlobHead(repoPath, rev, filePath string, n int) ([]byte, error) {
+	cmd := exec.Command("git", "cat-file", "blob", rev+":"+filePath)
+	cmd.Dir = repoPath
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, n)
+	read, err := io.ReadFull(stdout, head)
+	io.Copy(ioutil.Discard, stdout)
+	waitErr := cmd.Wait()
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if waitErr != nil {
+		return nil, waitErr
+	}
+	return head[:read], nil
+}
+
+// blobSize returns the size of the file at rev
+func blobSize(repoPath, rev, filePath string) (int64, error) {
+	cmd := exec.Command("git", "cat-file", "-s", rev+":"+filePath)
+	cmd.Dir = repoPath
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+// isBinaryContent asks file(1) about the content, falling back to git's NUL byte heuristic
+func isBinaryContent(head []byte) bool {
+	cmd := exec.Command("file", "--mime", "-")
+	cmd.Stdin = bytes.NewReader(head)
+	out, err := cmd.Output()
+	if err != nil {
+		return bytes.IndexByte(head, 0) > -1
+	}
+	return strings.Contains(string(out), "charset=binary")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveRevFetchesNewRefs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gitfluence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	// the remote is a local repo
+	defer func(config []string) { gitRemoteConfig = config }(gitRemoteConfig)
+	gitRemoteConfig = nil
+
+	remote := filepath.Join(tmp, "remote")
+	gitTestRepo(t, remote, "alice@example.com", map[string]string{"a.txt": "a\n"})
+	mirror := filepath.Join(tmp, "mirror")
+	if out, err := exec.Command("git", "clone", "-q", remote, mirror).CombinedOutput(); err != nil {
+		t.Fatalf("git clone: %v\n%s", err, out)
+	}
+
+	// pushed after the mirror was fetched
+	cmd := exec.Command("git", "-c", "user.name=Test", "-c", "user.email=bob@example.com", "commit", "-q", "--allow-empty", "-m", "feature")
+	cmd.Dir = remote
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git commit: %v\n%s", err, out)
+	}
+	for _, args := range [][]string{{"branch", "feature"}, {"tag", "v1"}} {
+		cmd = exec.Command("git", args...)
+		cmd.Dir = remote
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	want, err := gitRevParse(remote, "feature")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ref := range []string{"feature", "v1"} {
+		rc := RepoConfig{URL: "https://example.com/owner/repo", Ref: ref}
+		sha, err := rc.ResolveRev(context.Background(), mirror)
+		if err != nil {
+			t.Fatalf("%s: %v", ref, err)
+		}
+		if sha != want {
+			t.Errorf("%s: got %s, want %s", ref, sha, want)
+		}
+	}
+
+	rc := RepoConfig{URL: "https://example.com/owner/repo", Ref: "missing"}
+	if _, err := rc.ResolveRev(context.Background(), mirror); err == nil || isTemporary(err) {
+		t.Errorf("got %v for a ref missing after the fetch, want a permanent error", err)
+	}
+}
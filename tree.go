@@ -0,0 +1,226 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MongoDB documents are limited to 16 MB, the rest of the saved repo has to fit too
+const MAX_STAT_BSON_SIZE = 15 << 20
+
+// DirStat is a directory or a file of the repo with the lines every user owns under it.
+// Generated lines don't count, they say nothing about ownership
+type DirStat struct {
+	Name      string
+	File      bool `bson:",omitempty"`
+	Lines     LinesStat
+	CodeLines LinesStat      `bson:",omitempty"` // part of Lines
+	Users     []*DirUserStat // sorted by total lines
+	Children  []*DirStat     `bson:",omitempty"` // sorted by name
+}
+
+// DirUserStat are the lines of a user under a directory, Email matches UserStat.Email
+type DirUserStat struct {
+	Email     string
+	Lines     LinesStat
+	CodeLines LinesStat `bson:",omitempty"`
+}
+
+type ByDirUserLines []*DirUserStat
+
+func (a ByDirUserLines) Len() int      { return len(a) }
+func (a ByDirUserLines) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByDirUserLines) Less(i, j int) bool {
+	if a[i].Lines.Total != a[j].Lines.Total {
+		return a[i].Lines.Total > a[j].Lines.Total
+	}
+	return a[i].Email < a[j].Email
+}
+
+type ByDirName []*DirStat
+
+func (a ByDirName) Len() int           { return len(a) }
+func (a ByDirName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByDirName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// dirBuilder collects the tree in maps, DirStat keeps slices since file names and emails can't be BSON keys
+type dirBuilder struct {
+	name     string
+	file     bool
+	users    map[string]*DirUserStat
+	children map[string]*dirBuilder
+}
+
+func newDirBuilder(name string) *dirBuilder {
+	return &dirBuilder{name: name, users: make(map[string]*DirUserStat), children: make(map[string]*dirBuilder)}
+}
+
+// add accounts the user lines to the file and to every directory above it
+func (b *dirBuilder) add(filePath, email string, lines, codeLines LinesStat) {
+	node := b
+	parts := strings.Split(filePath, "/")
+	for i := 0; ; i++ {
+		if _, exists := node.users[email]; !exists {
+			node.users[email] = &DirUserStat{Email: email}
+		}
+		node.users[email].Lines.Append(lines)
+		node.users[email].CodeLines.Append(codeLines)
+		if i == len(parts) {
+			node.file = true
+			return
+		}
+
+		child, exists := node.children[parts[i]]
+		if !exists {
+			child = newDirBuilder(parts[i])
+			node.children[parts[i]] = child
+		}
+		node = child
+	}
+}
+
+func (b *dirBuilder) build() *DirStat {
+	d := DirStat{Name: b.name, File: b.file}
+	for _, u := range b.users {
+		d.Lines.Append(u.Lines)
+		d.CodeLines.Append(u.CodeLines)
+		d.Users = append(d.Users, u)
+	}
+	sort.Sort(ByDirUserLines(d.Users))
+	for _, child := range b.children {
+		d.Children = append(d.Children, child.build())
+	}
+	sort.Sort(ByDirName(d.Children))
+	return &d
+}
+
+// buildTree aggregates file stats into the repo tree. Users must be merged already, so every address maps to its final identity
+func (rs *RepoStat) buildTree(filesStat map[string]*FileStat) {
+	root := newDirBuilder("")
+	for file, fs := range filesStat {
+		for email, us := range fs.Users {
+			owner, exists := rs.usersMap[CanonicalEmail(email)]
+			if !exists {
+				continue
+			}
+			lines := LinesStat{}
+			lines.Append(us.CodeLines)
+			lines.Append(us.TestLines)
+			lines.Append(us.DocLines)
+			lines.Append(us.Resources)
+			if lines.Total > 0 {
+				root.add(file, owner.Email, lines, us.CodeLines)
+			}
+		}
+	}
+	rs.Tree = root.build()
+}
+
+// Derive computes the named windows of the node and its children relative to now
+func (d *DirStat) Derive(now time.Time) {
+	d.Lines.Derive(now)
+	d.CodeLines.Derive(now)
+	for _, u := range d.Users {
+		u.Lines.Derive(now)
+		u.CodeLines.Derive(now)
+	}
+	for _, child := range d.Children {
+		child.Derive(now)
+	}
+}
+
+// Find returns the node of a slash-separated path relative to the repo root, nil if there is none
+func (d *DirStat) Find(dirPath string) *DirStat {
+	node := d
+	for _, part := range strings.Split(strings.Trim(dirPath, "/"), "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		var next *DirStat
+		for _, child := range node.Children {
+			if child.Name == part {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		node = next
+	}
+	return node
+}
+
+// dropMonths forgets the month breakdown of the node lines, the named windows stay as last derived.
+// With files only, directories keep theirs
+func (d *DirStat) dropMonths(filesOnly bool) {
+	if d.File || !filesOnly {
+		d.Lines.Months = nil
+		d.CodeLines.Months = nil
+		for _, u := range d.Users {
+			u.Lines.Months = nil
+			u.CodeLines.Months = nil
+		}
+	}
+	for _, child := range d.Children {
+		child.dropMonths(filesOnly)
+	}
+}
+
+// depth returns the number of levels below the node
+func (d *DirStat) depth() int {
+	depth := 0
+	for _, child := range d.Children {
+		if c := child.depth() + 1; c > depth {
+			depth = c
+		}
+	}
+	return depth
+}
+
+// prune drops the nodes more than depth levels below the node, their lines stay counted in their parents
+func (d *DirStat) prune(depth int) {
+	if depth <= 0 {
+		d.Children = nil
+		return
+	}
+	for _, child := range d.Children {
+		child.prune(depth - 1)
+	}
+}
+
+func (rs *RepoStat) bsonSize() int {
+	data, err := bson.Marshal(rs)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// compact keeps the stat within MAX_STAT_BSON_SIZE. Files never keep months, the tree of big repos loses
+// its months, then its deeper levels and at last the whole tree. Windows must be derived before
+func (rs *RepoStat) compact() {
+	if rs.Tree == nil {
+		return
+	}
+	rs.Tree.dropMonths(true)
+	if rs.bsonSize() <= MAX_STAT_BSON_SIZE {
+		return
+	}
+	log.WithField("commit", rs.Commit).Warn("Stat is too large, dropping months of the tree")
+	rs.Tree.dropMonths(false)
+
+	for depth := rs.Tree.depth() / 2; rs.bsonSize() > MAX_STAT_BSON_SIZE; depth /= 2 {
+		if depth == 0 {
+			log.WithField("commit", rs.Commit).Warn("Stat is too large, dropping the tree")
+			rs.Tree = nil
+			return
+		}
+		log.WithField("commit", rs.Commit).WithField("depth", depth).Warn("Stat is too large, pruning the tree")
+		rs.Tree.prune(depth)
+	}
+}
@@ -1,29 +1,139 @@
 package main
 
+import (
+	"strings"
+	"time"
+)
+
 type Color struct {
 	R int
 	G int
 	B int
 }
 type UserStat struct {
-	CodeLines   LinesStat             `bson:",omitempty"`
-	DocLines    LinesStat             `bson:",omitempty"`
-	TestLines   LinesStat             `bson:",omitempty"`
-	Resources   LinesStat             `bson:",omitempty"`
-	LinesPerExt map[string]*LinesStat `bson:",omitempty"`
-	Email       string
-	CommitID    string `bson:",omitempty"`
-	CommitDays  int    `bson:",omitempty"`
-	Username    string `bson:",omitempty"`
-	Color       Color
+	CodeLines      LinesStat             `bson:",omitempty"`
+	DocLines       LinesStat             `bson:",omitempty"`
+	TestLines      LinesStat             `bson:",omitempty"`
+	Resources      LinesStat             `bson:",omitempty"`
+	Generated      LinesStat             `bson:",omitempty"`
+	LinesPerExt    map[string]*LinesStat `bson:",omitempty"`
+	Email          string
+	Emails         []string  `bson:",omitempty"` // all addresses merged into this identity
+	CommitID       string    `bson:",omitempty"`
+	CommitDays     int       `bson:",omitempty"` // age of the oldest line, CommitID is its commit
+	LastCommitTime time.Time `bson:",omitempty"` // author time of the newest line
+	Username       string    `bson:",omitempty"`
+	Color          Color
 }
 
+// LinesStat counts lines by the month they were last changed in. The named windows are derived from Months
+// relative to the time the stat is read, see Derive, stats analyzed before Months was kept only have them stored
 type LinesStat struct {
 	LastMonth  int `bson:",omitempty"`
 	Last3Month int `bson:",omitempty"`
 	Last6Month int `bson:",omitempty"`
 	LastYear   int `bson:",omitempty"`
 	Total      int `bson:",omitempty"`
+
+	Months map[string]int `bson:",omitempty" json:",omitempty"` // "2006-01" of the author time in UTC -> lines
+}
+
+const LINES_MONTH_FORMAT = "2006-01"
+
+// LINES_WINDOWS are the LinesStat time windows, from the shortest
+var LINES_WINDOWS = []string{"LastMonth", "Last3Month", "Last6Month", "LastYear", "Total"}
+
+// months covered by the named windows
+var WINDOW_MONTHS = map[string]int{"LastMonth": 1, "Last3Month": 3, "Last6Month": 6, "LastYear": 12}
+
+// ParseWindow returns the LinesStat field name of a case-insensitive window name,
+// or the "2006-01..2006-12" month range as is. Either end of the range may be omitted
+func ParseWindow(window string) (string, bool) {
+	for _, w := range LINES_WINDOWS {
+		if strings.EqualFold(w, window) {
+			return w, true
+		}
+	}
+	from, to, isRange := splitMonthRange(window)
+	if !isRange || from == "" && to == "" {
+		return "", false
+	}
+	for _, month := range []string{from, to} {
+		if _, err := time.Parse(LINES_MONTH_FORMAT, month); month != "" && err != nil {
+			return "", false
+		}
+	}
+	if to != "" && from > to {
+		return "", false
+	}
+	return window, true
+}
+
+func splitMonthRange(window string) (from, to string, ok bool) {
+	f := strings.Split(window, "..")
+	if len(f) != 2 {
+		return "", "", false
+	}
+	return f[0], f[1], true
+}
+
+// windowStart returns the first month of the named window. Lines are kept by month, so the rolling window of n months
+// is approximated by the n complete months before the current one and the current month so far
+func windowStart(window string, now time.Time) string {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month()-time.Month(WINDOW_MONTHS[window]), 1, 0, 0, 0, 0, time.UTC).Format(LINES_MONTH_FORMAT)
+}
+
+// Window returns the lines of the window returned by ParseWindow, relative to now
+func (l *LinesStat) Window(window string) int {
+	if from, to, isRange := splitMonthRange(window); isRange {
+		return l.Range(from, to)
+	}
+	if _, named := WINDOW_MONTHS[window]; named && l.Months != nil {
+		return l.Range(windowStart(window, time.Now()), "")
+	}
+	switch window {
+	case "LastMonth":
+		return l.LastMonth
+	case "Last3Month":
+		return l.Last3Month
+	case "Last6Month":
+		return l.Last6Month
+	case "LastYear":
+		return l.LastYear
+	}
+	return l.Total
+}
+
+// Range returns the lines changed from the month to the month inclusive, an empty month leaves the range open
+func (l *LinesStat) Range(from, to string) int {
+	lines := 0
+	for month, n := range l.Months {
+		if month >= from && (to == "" || month <= to) {
+			lines += n
+		}
+	}
+	return lines
+}
+
+// Derive computes the named windows from Months relative to now
+func (l *LinesStat) Derive(now time.Time) {
+	if l.Months == nil {
+		return
+	}
+	l.LastMonth = l.Range(windowStart("LastMonth", now), "")
+	l.Last3Month = l.Range(windowStart("Last3Month", now), "")
+	l.Last6Month = l.Range(windowStart("Last6Month", now), "")
+	l.LastYear = l.Range(windowStart("LastYear", now), "")
+}
+
+// add counts a line changed at the time, the windows are left for Derive
+func (l *LinesStat) add(authorTime time.Time) {
+	if l.Months == nil {
+		l.Months = make(map[string]int)
+	}
+	l.Months[authorTime.UTC().Format(LINES_MONTH_FORMAT)]++
+	l.Total++
 }
 
 func (l *LinesStat) Percent(total int) int {
@@ -36,34 +146,131 @@ func (l *LinesStat) Append(lines LinesStat) {
 	l.Last6Month += lines.Last6Month
 	l.LastYear += lines.LastYear
 	l.Total += lines.Total
+	for month, n := range lines.Months {
+		if l.Months == nil {
+			l.Months = make(map[string]int)
+		}
+		l.Months[month] += n
+	}
+}
+
+func (u *UserStat) addEmail(email string) {
+	email = strings.ToLower(email)
+	for _, e := range u.Emails {
+		if e == email {
+			return
+		}
+	}
+	u.Emails = append(u.Emails, email)
+}
+
+// Merge adds lines and addresses of another identity of the same person
+func (u *UserStat) Merge(o *UserStat) {
+	u.CodeLines.Append(o.CodeLines)
+	u.DocLines.Append(o.DocLines)
+	u.TestLines.Append(o.TestLines)
+	u.Resources.Append(o.Resources)
+	u.Generated.Append(o.Generated)
+
+	for ext, lines := range o.LinesPerExt {
+		if u.LinesPerExt == nil {
+			u.LinesPerExt = make(map[string]*LinesStat)
+		}
+		if _, exists := u.LinesPerExt[ext]; !exists {
+			u.LinesPerExt[ext] = &LinesStat{}
+		}
+		u.LinesPerExt[ext].Append(*lines)
+	}
+	for _, email := range o.Emails {
+		u.addEmail(email)
+	}
+	if u.CommitDays < o.CommitDays || u.CommitID == "" {
+		u.CommitID = o.CommitID
+		u.CommitDays = o.CommitDays
+	}
+	if o.LastCommitTime.After(u.LastCommitTime) {
+		u.LastCommitTime = o.LastCommitTime
+	}
 }
 
 type FileStat struct {
-	IsDoc      bool
-	IsTest     bool
-	IsBinary   bool
-	TotalLines int
-	Users      map[string]*UserStat
+	IsDoc       bool
+	IsTest      bool
+	IsBinary    bool
+	IsGenerated bool
+	TotalLines  int
+	Users       map[string]*UserStat
 }
 
 type RepoStat struct {
+	Commit     string    `bson:",omitempty"` // HEAD SHA the stat was computed at
+	CommitTime time.Time `bson:",omitempty"`
+
 	CodeLines LinesStat
 	TestLines LinesStat
 	DocLines  LinesStat
 	Resources LinesStat
+	Generated LinesStat
 
 	usersMap map[string]*UserStat
 	Users    []*UserStat
-	//Files map[string]*FileStat
+	Tree     *DirStat `bson:",omitempty"` // ownership of every directory and file
+
+	// CODEOWNERS of the repo at Commit
+	CodeOwnersPath string `bson:",omitempty"`
+	CodeOwners     string `bson:",omitempty"`
+}
+
+// Derive computes the named windows of all lines of the stat relative to now
+func (rs *RepoStat) Derive(now time.Time) {
+	for _, l := range []*LinesStat{&rs.CodeLines, &rs.TestLines, &rs.DocLines, &rs.Resources, &rs.Generated} {
+		l.Derive(now)
+	}
+	for _, u := range rs.Users {
+		for _, l := range []*LinesStat{&u.CodeLines, &u.TestLines, &u.DocLines, &u.Resources, &u.Generated} {
+			l.Derive(now)
+		}
+		for _, l := range u.LinesPerExt {
+			l.Derive(now)
+		}
+	}
+	if rs.Tree != nil {
+		rs.Tree.Derive(now)
+	}
+}
+
+// mergeByUsername joins users resolved to the same account, Users must be sorted by lines
+func (rs *RepoStat) mergeByUsername() {
+	byLogin := make(map[string]*UserStat)
+	users := rs.Users[:0]
+	for _, u := range rs.Users {
+		if u.Username == "" {
+			users = append(users, u)
+			continue
+		}
+		login := strings.ToLower(u.Username)
+		if first, exists := byLogin[login]; exists {
+			first.Merge(u)
+			rs.usersMap[u.Email] = first
+			continue
+		}
+		byLogin[login] = u
+		users = append(users, u)
+	}
+	rs.Users = users
 }
 
 type RepoConfig struct {
-	URL string
+	URL  string
+	Ref  string // branch, tag or SHA, HEAD if empty
+	AsOf string // analyze the last commit before the date
 }
 type Repo struct {
 	Hash  string
 	Host  string
 	Owner string
 	Name  string
+	Ref   string `bson:",omitempty"`
+	AsOf  string `bson:",omitempty"`
 	Stat  *RepoStat
 }
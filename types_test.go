@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowStart(t *testing.T) {
+	tests := []struct {
+		now    time.Time
+		window string
+		start  string
+	}{
+		{time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC), "LastMonth", "2024-04"},
+		{time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC), "Last3Month", "2024-02"},
+		{time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC), "Last6Month", "2023-11"},
+		{time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC), "LastYear", "2023-05"},
+		// the previous month still counts on the first day of a month
+		{time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), "LastMonth", "2024-05"},
+		{time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), "LastMonth", "2023-12"},
+		{time.Date(2024, 3, 1, 0, 30, 0, 0, time.FixedZone("CET", 3600)), "LastMonth", "2024-01"},
+	}
+	for _, tt := range tests {
+		if start := windowStart(tt.window, tt.now); start != tt.start {
+			t.Errorf("%s at %v: got %s, want %s", tt.window, tt.now, start, tt.start)
+		}
+	}
+}
+
+func TestLinesStatDerive(t *testing.T) {
+	l := LinesStat{}
+	for _, at := range []time.Time{
+		time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC),
+		time.Date(2023, 8, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		l.add(at)
+	}
+	l.Derive(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	if l.LastMonth != 2 || l.Last3Month != 3 || l.Last6Month != 3 || l.LastYear != 4 || l.Total != 5 {
+		t.Errorf("got %+v", l)
+	}
+}
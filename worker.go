@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
@@ -10,6 +12,7 @@ import (
 	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,10 +25,7 @@ import (
 	"io/ioutil"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/davecgh/go-spew/spew"
 	"github.com/gin-gonic/gin"
-	"github.com/google/go-github/github"
-	"golang.org/x/oauth2"
 )
 
 var DOC_EXTS = []string{"md", "markdown", "mdown", "mkdn", "mdwn", "mdtxt", "txt", "text", "doc", "htm", "html"}
@@ -34,7 +34,9 @@ var DEPS_REGEXPS = []string{`(^|/)cache/`, `^[Dd]ependencies/`, `^deps/`, `^tool
 
 var depRegexp *regexp.Regexp
 
-const REPOS_DIR = "/tmp/repos"
+// mirrors of analyzed repos, every worker on a host needs its own
+var reposDir = "/tmp/repos"
+
 const TOP_REPO_USERS = 15
 
 func MD5(text string) string {
@@ -85,63 +87,24 @@ func (a ByLines) Less(i, j int) bool {
 }
 
 func init() {
-	if !exists(REPOS_DIR) {
-		os.MkdirAll(REPOS_DIR, 0777)
-	}
-
 	depRegexp = regexp.MustCompile(strings.Join(DEPS_REGEXPS, "|"))
 	/*for _,re:=range DEPS_REGEXPS{
 		depRegexpStr+="("
 	}*/
 }
 
-func (repo RepoConfig) GitClone() (string, error) {
-	host, owner, name, err := repo.ParseURL()
-
-	if err != nil {
-		return "", err
-	}
-
-	repoDst := REPOS_DIR + "/" + host + "/" + owner + "/" + name
-
-	if exists(repoDst) {
-		return repoDst, nil
-	} else {
-		cmd := exec.Command("git", "clone", repo.URL, repoDst)
-		cmd.Stderr = os.Stderr
-		_, err := cmd.Output()
-		if err != nil {
-			return "", err
-		}
-		return repoDst, nil
-	}
-}
-
 func isDir(path string) bool {
 	s, err := os.Stat(path)
 	return err == nil && s.IsDir()
 }
 
-func RepoListFiles(repoPath string) ([]string, error) {
-	cmd := exec.Command("git", "ls-tree", "-z", "-r", "HEAD", "--name-only")
-	cmd.Dir = repoPath
-	cmd.Stderr = os.Stderr
-	lines, err := cmd.Output()
-
+func RepoListFiles(repoPath string, rev string) ([]string, error) {
+	blobs, err := RepoListBlobs(repoPath, rev)
 	if err != nil {
 		return nil, err
 	}
-	paths := strings.Split(string(lines), "\x00")
-
-	fmt.Printf("FFiles: \n%v", strings.Join(paths, "\n"))
-	var files []string
-	for _, f := range paths {
-		if !isDir(filepath.Join(repoPath, f)) {
-			files = append(files, f)
-		}
-	}
 
-	return files, nil
+	return sortedKeys(blobs), nil
 }
 
 func RepoListNonBinaryFiles(repoPath string) ([]string, error) {
@@ -212,90 +175,44 @@ func RepoListBinaryFiles(repoPath string) ([]string, error) {
 	return files, nil
 }*/
 
-var blameHeaderRE = regexp.MustCompile("(.*?)?([0-9a-f]{40})\\s([^(]*)?\\(<([^>]*[^0-9]*)([^\\s]*\\s[^\\s]*\\s[^\\s]*)(\\s*[0-9]*\\))\\s[^\\n]*")
-
-func GithubUsernameFromAPI(owner, repo, commitID string) (string, error) {
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: "cfb633bfe4d5bdbd202c023cfa092fc4e9d3a45c"},
-	)
-	tc := oauth2.NewClient(oauth2.NoContext, ts)
+func BlameFile(ctx context.Context, repoPath string, filePath string, rev string, attrs FileAttrs) (*FileStat, error) {
 
-	client := github.NewClient(tc)
-
-	commit, _, err := client.Repositories.GetCommit(owner, repo, commitID)
-
-	//rl, _, _ := client.RateLimits()
-	//	fmt.Printf("RAte limits %v, %v", rl.Core, rl.Search)
-	if err != nil {
-		return "", err
-	}
-
-	if commit == nil {
-		return "", err
-	}
-
-	if commit.Author == nil {
-		return "", err
-	}
-	return *commit.Author.Login, nil
-}
-
-func GithubUsername(owner, repo, commitID string) string {
-	login, err := GithubUsernameFromAPI(owner, repo, commitID)
-
-	if err != nil {
-		fmt.Printf("GithubUsernameByCommitFromAPI: %v", err.Error())
-	}
-	return login
-
-}
-func BlameFile(repoPath string, filePath string) (*FileStat, error) {
-
-	if depRegexp.MatchString(filePath) {
+	if attrs.IsVendored(filePath) {
 		return nil, errors.New("File is dependence")
 	}
 	fs := FileStat{Users: make(map[string]*UserStat)}
 
-	cmd := exec.Command("file", "--mime", filePath)
-	cmd.Dir = repoPath
-	cmd.Stderr = os.Stderr
-	out, err := cmd.Output()
-
-	if strings.Contains(string(out), "charset=binary") {
-		fs.IsBinary = true
-		cmd = exec.Command("git", "log", "-n", "1", "--format='%H (<%aE> %ai 1) BINARY'", filePath)
-		cmd.Dir = repoPath
-		cmd.Stderr = os.Stderr
-		out, err = cmd.Output()
-	} else {
-		cmd = exec.Command("git", "blame", "-w", "-M", "-l", "-C", "-e", "--", filePath)
-		cmd.Dir = repoPath
-		cmd.Stderr = os.Stderr
-		out, err = cmd.Output()
-
-		if strings.Contains(filePath, "doc/") || strings.Contains(filePath, "docs/") || strings.Contains(filePath, "help/") {
-			fs.IsDoc = true
+	if maxFileSize > 0 {
+		size, err := blobSize(repoPath, rev, filePath)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxFileSize {
+			log.WithField("file", filePath).WithField("size", size).Warn("File is too large, skipped")
+			return nil, nil
 		}
 	}
 
+	head, err := readBlobHead(repoPath, rev, filePath, BLOB_HEAD_SIZE)
 	if err != nil {
 		return nil, err
 	}
+	if len(head) == 0 {
+		return nil, nil
+	}
 
-	if len(out) < 1 {
-
-		fileInfo, err := os.Stat(filepath.Join(repoPath, filePath))
-		if err != nil {
-			return nil, err
-		}
-		if fileInfo.Size() == 0 {
-			return nil, nil
-		}
-		//TODO: binary file?
-
-		return nil, errors.New("Bad git-blame output")
+	if isBinaryContent(head) {
+		fs.IsBinary = true
+	} else if strings.Contains(filePath, "doc/") || strings.Contains(filePath, "docs/") || strings.Contains(filePath, "help/") {
+		fs.IsDoc = true
 	}
+
 	ext := path.Ext(filePath)
+	syntax := CommentSyntaxFor(filePath)
+	if langExt := attrs.LanguageExt(); langExt != "" {
+		ext = langExt
+		syntax = CommentSyntaxForExt(langExt)
+	}
 
 	if len(ext) < 2 {
 		fs.IsDoc = true
@@ -310,130 +227,166 @@ func BlameFile(repoPath string, filePath string) (*FileStat, error) {
 		}
 	}
 
+	if attrs.Documentation == AttrSet {
+		fs.IsDoc = true
+	} else if attrs.Documentation == AttrUnset {
+		fs.IsDoc = false
+	}
+
+	if !fs.IsBinary && (attrs.Generated == AttrSet || attrs.Generated == AttrUnspecified && isGeneratedFile(filePath, head)) {
+		if skipGenerated {
+			return nil, nil
+		}
+		fs.IsGenerated = true
+	}
+
 	if !fs.IsDoc {
 		//TODO: handle specific test file cases
 		if strings.Contains(filePath, "test") {
 			fs.IsTest = true
 		}
 	}
-	m := 200
-	if m >= len(out) {
-		m = len(out) - 1
-	}
-	blameHeader := blameHeaderRE.FindStringSubmatch(string(out[0:m]))
-
-	if len(blameHeader) < 6 {
-		return nil, errors.New("bad row: " + string(out[0:200]))
-	}
-	l0 := len(blameHeader[1])
-	l1 := len(blameHeader[2])
-	l2 := len(blameHeader[3])
-	l3 := len(blameHeader[4])
-	l4 := len(blameHeader[5])
-	l5 := len(blameHeader[6])
-
-	//spew.Dump(blameHeader)
 
-	pos := 0
-	now := time.Now().Unix()
-	c := l0
-	commentStarted := false
+	now := time.Now()
 
-	for c < len(out) {
+	if fs.IsBinary {
+		bl, err := lastCommitLine(repoPath, rev, filePath)
+		if err != nil {
+			return nil, err
+		}
+		if bl != nil {
+			fs.addLine(bl, false, now)
+		}
+	} else {
+		// blame maps authors through .mailmap of the working tree, so the latest mapping applies to old revs too
+		cmd := exec.CommandContext(ctx, "git", "blame", "--line-porcelain", "-w", "-M", "-C", rev, "--", filePath)
+		cmd.Dir = repoPath
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, err
+		}
 
-		/// start the new line
-		fs.TotalLines++
+		parser := NewBlameParser(stdout, filePath)
+		comments := NewCommentClassifier(syntax)
+		for {
+			bl, err := parser.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				io.Copy(ioutil.Discard, stdout)
+				cmd.Wait()
+				return nil, err
+			}
 
-		pos = l1 + l2
+			// classifier has to see every line to track multi-line comments
+			lineIsComment := comments.IsComment(bl.Content) && !fs.IsDoc
+			fs.addLine(bl, lineIsComment, now)
+		}
 
-		for out[c+pos] != '>' {
-			pos++
+		if err = cmd.Wait(); err != nil {
+			return nil, err
 		}
-		email := string(out[c+l1+l2+3 : c+pos])
-		//fmt.Println("email: "+email)
-		pos = l1 + l2 + l3
+	}
 
-		date, _ := time.Parse("2006-01-02 15:04:05 -0700", string(out[c+pos+3:c+pos+3+25]))
-		daysAfterCommit := int(float64((now - date.Unix())) / (60 * 60 * 24))
-		//fmt.Printf("%v %v, %d\n", string(out[c+pos+3:c+pos+3+25]), date.Unix(), daysAfterCommit)
+	if fs.TotalLines == 0 {
 
-		if _, exists := fs.Users[email]; !exists {
-			fs.Users[email] = &UserStat{}
+		size, err := blobSize(repoPath, rev, filePath)
+		if err != nil {
+			return nil, err
 		}
-		if fs.Users[email].CommitDays < daysAfterCommit {
-			fs.Users[email].CommitID = string(out[c : c+l1])
-			fs.Users[email].CommitDays = daysAfterCommit
+		if size == 0 {
+			return nil, nil
 		}
 
-		c = c + l1 + l2 + l3 + l4 + l5
+		return nil, errors.New("Bad git-blame output for " + filePath)
+	}
 
-		lineStart := c
-		for out[c] != '\n' {
-			c++
-		}
-		lineIsComment := false
+	return &fs, nil
+}
 
-		if !fs.IsDoc {
-			line := string(out[lineStart:c])
+// lastCommitLine describes the last commit touched the binary file as a single blame line
+func lastCommitLine(repoPath string, rev string, filePath string) (*BlameLine, error) {
+	cmd := exec.Command("git", "log", "-n", "1", "--format=%H%n%an%n%aE%n%at%n%s", rev, "--", filePath)
+	cmd.Dir = repoPath
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
 
-			//TODO: other language comments handling
-			if !commentStarted {
-				first2Symbol := strings.TrimSpace(line)[0:1]
+	f := strings.SplitN(strings.TrimSuffix(string(out), "\n"), "\n", 5)
+	if len(f) < 4 {
+		return nil, &BlameParseError{File: filePath, Line: 1, Msg: fmt.Sprintf("bad git-log output %q", out)}
+	}
+	t, err := strconv.ParseInt(f[3], 10, 64)
+	if err != nil {
+		return nil, &BlameParseError{File: filePath, Line: 1, Msg: fmt.Sprintf("bad author time %q", f[3])}
+	}
+	bl := BlameLine{Commit: f[0], Author: f[1], AuthorMail: f[2], AuthorTime: time.Unix(t, 0), OrigPath: filePath, OrigLine: 1, FinalLine: 1}
+	if len(f) > 4 {
+		bl.Summary = f[4]
+	}
+	return &bl, nil
+}
 
-				if first2Symbol == "//" {
-					lineIsComment = true
-				} else if first2Symbol == "/*" {
-					commentStarted = true
-					lineIsComment = true
-				} else if first2Symbol[0:0] == "#" {
-					lineIsComment = true
-				}
-			} else {
-				lineIsComment = true
-				if strings.Contains(line, "*/") {
-					commentStarted = false
-				}
-			}
+// addLine accounts a single blamed line to its author
+func (fs *FileStat) addLine(bl *BlameLine, lineIsComment bool, now time.Time) {
+	fs.TotalLines++
 
-		}
-		var linesStat *LinesStat
-		if fs.IsBinary {
-			linesStat = &fs.Users[email].Resources
-		} else if lineIsComment || fs.IsDoc {
-			linesStat = &fs.Users[email].DocLines
-		} else if fs.IsTest {
-			linesStat = &fs.Users[email].TestLines
-		} else {
-			linesStat = &fs.Users[email].CodeLines
-		}
-
-		linesStat.Total++
-		if daysAfterCommit < 366 {
-			linesStat.LastYear++
-			if daysAfterCommit < 184 {
-				linesStat.Last6Month++
-				if daysAfterCommit < 93 {
-					linesStat.Last3Month++
-					if daysAfterCommit < 32 {
-						linesStat.LastMonth++
-					}
-				}
-			}
-		}
+	email := bl.AuthorMail
+	daysAfterCommit := int(now.Sub(bl.AuthorTime).Hours() / 24)
 
-		c++
+	if _, exists := fs.Users[email]; !exists {
+		fs.Users[email] = &UserStat{}
+	}
+	if fs.Users[email].CommitDays < daysAfterCommit || fs.Users[email].CommitID == "" {
+		fs.Users[email].CommitID = bl.Commit
+		fs.Users[email].CommitDays = daysAfterCommit
+	}
+	if bl.AuthorTime.After(fs.Users[email].LastCommitTime) {
+		fs.Users[email].LastCommitTime = bl.AuthorTime
+	}
 
+	var linesStat *LinesStat
+	if fs.IsBinary {
+		linesStat = &fs.Users[email].Resources
+	} else if fs.IsGenerated {
+		linesStat = &fs.Users[email].Generated
+	} else if lineIsComment || fs.IsDoc {
+		linesStat = &fs.Users[email].DocLines
+	} else if fs.IsTest {
+		linesStat = &fs.Users[email].TestLines
+	} else {
+		linesStat = &fs.Users[email].CodeLines
 	}
-	return &fs, nil
+
+	linesStat.add(bl.AuthorTime)
 }
 
-func (r *RepoConfig) Stat() (*RepoStat, error) {
-	repoPath, err := r.GitClone()
+func (r *RepoConfig) Stat(ctx context.Context, report JobReporter) (*RepoStat, error) {
+	reportPhase(report, JobCloning)
+	repoPath, err := r.GitClone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkRepoSize(repoPath); err != nil {
+		return nil, err
+	}
+	rev, err := r.ResolveRev(ctx, repoPath)
 	if err != nil {
 		return nil, err
 	}
 	var repoStat *RepoStat
-	repoStat, err = BlameRepo(repoPath)
+	reportPhase(report, JobBlaming)
+	repoStat, err = BlameRepo(ctx, *r, repoPath, rev, report)
 	if err != nil {
 		return nil, err
 	}
@@ -441,15 +394,49 @@ func (r *RepoConfig) Stat() (*RepoStat, error) {
 	return repoStat, nil
 }
 
-func BlameRepo(repoPath string) (*RepoStat, error) {
+// BlameRepo blames all files of the commit rev in the mirror of the repo, authors are resolved on the repo host
+func BlameRepo(ctx context.Context, repo RepoConfig, repoPath string, rev string, report JobReporter) (*RepoStat, error) {
+	// mirror paths escape GitLab subgroups, the resolvers take the owner as is
+	host, owner, name, err := repo.ParseURL()
+	if err != nil {
+		return nil, permanentError("Bad repo URL %q: %v", repo.URL, err)
+	}
 
-	rs := RepoStat{}
+	rs := RepoStat{Commit: rev}
 	filesStat := make(map[string]*FileStat)
 
-	files, err := RepoListFiles(repoPath)
+	blobs, err := RepoListBlobs(repoPath, rev)
 	if err != nil {
 		return nil, err
 	}
+	rs.CodeOwnersPath, rs.CodeOwners, err = readCodeOwners(repoPath, rev, blobs)
+	if err != nil {
+		log.WithError(err).Warn("Can't read CODEOWNERS")
+	}
+	if rs.CommitTime, err = commitTime(repoPath, rev); err != nil {
+		log.WithError(err).Warn("Can't read commit time")
+	}
+	files := sortedKeys(blobs)
+
+	attrs, err := RepoCheckAttrs(repoPath, rev, files)
+	if err != nil {
+		log.WithError(err).Warn("Can't read .gitattributes, using built-in rules only")
+		attrs = make(map[string]FileAttrs)
+	}
+
+	// only files touched since the last analyzed commit are blamed again
+	cache := loadBlameCache(repoPath)
+	var changed map[string]bool
+	if cache != nil && cache.Commit != rev {
+		changed, err = RepoChangedFiles(repoPath, cache.Commit, rev)
+		// attributes change the file types and .mailmap the authors of every blamed line
+		if err != nil || changed[".gitattributes"] || changed[".mailmap"] {
+			log.WithError(err).WithField("commit", cache.Commit).Warn("Can't reuse blame cache")
+			cache = nil
+		}
+	}
+	newCache := BlameCache{Version: BLAME_CACHE_VERSION, Commit: rev, Files: make(map[string]*CachedFileStat)}
+
 	var mu sync.Mutex
 
 	wg := sync.WaitGroup{}
@@ -457,141 +444,294 @@ func BlameRepo(repoPath string) (*RepoStat, error) {
 	wgC := 0
 	fmt.Printf("CPUs: %d\n", runtime.NumCPU())
 	pool := make(chan bool, runtime.NumCPU())
+	blamed := 0
+	var toBlame []string
 	for _, file := range files {
 
 		file := string(file)
 		if file == "" {
 			continue
 		}
-		//TODO: more vendor dirs
+		fileAttrs := attrs[file]
 
-		if strings.HasPrefix(file, "vendor/") {
+		if fileAttrs.IsVendored(file) {
 			continue
 		}
-		if strings.HasPrefix(file, "pkg") {
-			continue
+
+		//TODO: more vendor dirs
+		if fileAttrs.Vendored != AttrUnset {
+			if strings.HasPrefix(file, "vendor/") {
+				continue
+			}
+			if strings.HasPrefix(file, "pkg") {
+				continue
+			}
+			if strings.HasPrefix(file, "bin") {
+				continue
+			}
 		}
-		if strings.HasPrefix(file, "bin") {
+
+		if cached, ok := cache.Lookup(file, blobs[file], changed); ok {
+			newCache.Files[file] = cached
+			if cached.Stat != nil && cached.Stat.TotalLines > 0 {
+				filesStat[file] = cached.Stat
+			}
+			blamed++
 			continue
 		}
+		toBlame = append(toBlame, file)
+	}
+
+	total := blamed + len(toBlame)
+	if maxRepoFiles > 0 && total > maxRepoFiles {
+		return nil, permanentError("Repo has %d files, the limit is %d", total, maxRepoFiles)
+	}
+	reportProgress(report, blamed, total)
 
+	for _, file := range toBlame {
+		if ctx.Err() != nil {
+			break
+		}
 		wg.Add(1)
 		wgC++
 
 		pool <- true
-		go func(mu *sync.Mutex, repoPath string, file string, rs *RepoStat) {
+		go func(mu *sync.Mutex, repoPath string, file string, fileAttrs FileAttrs, rs *RepoStat) {
 			fmt.Printf("File: %v\n", file)
 			defer func() {
 				<-pool
 				wg.Done()
 			}()
-			fs, err := BlameFile(repoPath, file)
+			fs, err := BlameFile(ctx, repoPath, file, rev, fileAttrs)
 			//spew.Dump(fs)
 			if err != nil {
 				log.WithError(err).WithField("file", file).Error("BlameFile returned error")
-			} else {
+			}
 
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				newCache.Files[file] = &CachedFileStat{Blob: blobs[file], Stat: fs}
 				if fs != nil && fs.TotalLines > 0 {
-					func() {
-						mu.Lock()
-						defer mu.Unlock()
-						filesStat[file] = fs
-
-					}()
-
+					filesStat[file] = fs
 				}
-
 			}
-		}(&mu, repoPath, file, &rs)
+			blamed++
+			reportProgress(report, blamed, total)
+		}(&mu, repoPath, file, attrs[file], &rs)
 
 	}
 	wg.Wait()
+
+	// files blamed before cancellation are kept for the next run
+	if err = newCache.Save(repoPath); err != nil {
+		log.WithError(err).Error("Can't save blame cache")
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	rs.usersMap = make(map[string]*UserStat)
 	for file, fs := range filesStat {
 		ext := path.Ext(file)
 
 		for email, us := range fs.Users {
-			if _, exists := rs.usersMap[email]; !exists {
+			key := CanonicalEmail(email)
+			if _, exists := rs.usersMap[key]; !exists {
 				us := UserStat{}
-				rs.usersMap[email] = &us
+				rs.usersMap[key] = &us
 				rs.Users = append(rs.Users, &us)
-				rs.usersMap[email].Email = email
-				rs.usersMap[email].LinesPerExt = make(map[string]*LinesStat)
+				rs.usersMap[key].Email = key
+				rs.usersMap[key].Username = noreplyLogin(key)
+				rs.usersMap[key].LinesPerExt = make(map[string]*LinesStat)
 			}
-			if rs.usersMap[email].CommitDays < us.CommitDays {
-				rs.usersMap[email].CommitID = us.CommitID
-				rs.usersMap[email].CommitDays = us.CommitDays
+			rs.usersMap[key].addEmail(email)
+			if rs.usersMap[key].CommitDays < us.CommitDays || rs.usersMap[key].CommitID == "" {
+				rs.usersMap[key].CommitID = us.CommitID
+				rs.usersMap[key].CommitDays = us.CommitDays
+			}
+			if us.LastCommitTime.After(rs.usersMap[key].LastCommitTime) {
+				rs.usersMap[key].LastCommitTime = us.LastCommitTime
 			}
 			rs.CodeLines.Append(us.CodeLines)
 			rs.TestLines.Append(us.TestLines)
 			rs.DocLines.Append(us.DocLines)
 			rs.Resources.Append(us.Resources)
+			rs.Generated.Append(us.Generated)
 
-			rs.usersMap[email].CodeLines.Append(us.CodeLines)
-			rs.usersMap[email].TestLines.Append(us.TestLines)
-			rs.usersMap[email].DocLines.Append(us.DocLines)
-			rs.usersMap[email].Resources.Append(us.Resources)
+			rs.usersMap[key].CodeLines.Append(us.CodeLines)
+			rs.usersMap[key].TestLines.Append(us.TestLines)
+			rs.usersMap[key].DocLines.Append(us.DocLines)
+			rs.usersMap[key].Resources.Append(us.Resources)
+			rs.usersMap[key].Generated.Append(us.Generated)
 
-			if _, exists := rs.usersMap[email].LinesPerExt[ext]; !exists {
-				rs.usersMap[email].LinesPerExt[ext] = &LinesStat{}
+			if _, exists := rs.usersMap[key].LinesPerExt[ext]; !exists {
+				rs.usersMap[key].LinesPerExt[ext] = &LinesStat{}
 			}
 
-			rs.usersMap[email].LinesPerExt[ext].Append(us.CodeLines)
-			rs.usersMap[email].LinesPerExt[ext].Append(us.TestLines)
-			rs.usersMap[email].LinesPerExt[ext].Append(us.DocLines)
-			rs.usersMap[email].LinesPerExt[ext].Append(us.Resources)
+			rs.usersMap[key].LinesPerExt[ext].Append(us.CodeLines)
+			rs.usersMap[key].LinesPerExt[ext].Append(us.TestLines)
+			rs.usersMap[key].LinesPerExt[ext].Append(us.DocLines)
+			rs.usersMap[key].LinesPerExt[ext].Append(us.Resources)
+			rs.usersMap[key].LinesPerExt[ext].Append(us.Generated)
 
 		}
 	}
 
 	sort.Sort(ByLines(rs.Users))
 
-	f := strings.Split(repoPath, "/")
-	owner := f[len(f)-2]
-	repo := f[len(f)-1]
-
+	reportPhase(report, JobResolving)
 	maxUsers := TOP_REPO_USERS
 	if len(rs.Users) < TOP_REPO_USERS {
 		maxUsers = len(rs.Users)
 	}
-	for i, user := range rs.Users[0:maxUsers] {
-		user.Username = GithubUsername(owner, repo, user.CommitID)
-		fmt.Printf("%d, %v: \n", i, user.Username)
-		spew.Dump(user)
+	for _, user := range rs.Users[0:maxUsers] {
+		if user.Username == "" {
+			user.Username, err = ResolveUsername(host, owner, name, user.CommitID, user.Email)
+			if isServerError(err) {
+				return nil, temporaryError("%s API: %v", host, err)
+			}
+		}
 	}
+
+	// the same account may commit from several addresses
+	rs.mergeByUsername()
+	sort.Sort(ByLines(rs.Users))
+	rs.buildTree(filesStat)
+	rs.Derive(time.Now())
+	rs.compact()
+
 	return &rs, nil
 }
 
-var tasks chan string
-var readyRepos = make(map[string]*Repo)
+// workerID owns the leases taken by this process
+var workerID = fmt.Sprintf("%s-%d-%d", hostname(), os.Getpid(), time.Now().UnixNano())
 
-func workerLoop() {
-	tasks = make(chan string, 65536)
+// workerNode is the URL the server reaches this worker at. Jobs queued on a node are claimed only by it
+var workerNode string
+
+// how often the worker looks for jobs queued by other processes
+const JOB_POLL_INTERVAL = 5 * time.Second
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "worker"
+	}
+	return name
+}
+
+// jobReporter moves the job through its phases and keeps its lease while the job is running
+type jobReporter struct {
+	hash string
+}
+
+func (r *jobReporter) Phase(state JobState) {
+	running.phase(r.hash, state)
+	if err := jobs.SetState(r.hash, workerID, state); err != nil {
+		log.WithError(err).WithField("job", r.hash).Error("Can't update job state")
+	}
+}
+
+func (r *jobReporter) Progress(files, totalFiles int) {
+	running.files(r.hash, files, totalFiles)
+}
+
+func (r *jobReporter) keepLease(done chan bool) {
+	ticker := time.NewTicker(JOB_LEASE / 4)
+	defer ticker.Stop()
 	for {
-		repoURL := <-tasks
-		fmt.Printf("Received task: %v\n", repoURL)
-		repoConfig := RepoConfig{URL: repoURL}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := jobs.Renew(r.hash, workerID); err != nil {
+				log.WithError(err).WithField("job", r.hash).Error("Can't renew job lease")
+			}
+		}
+	}
+}
 
-		var err error
-		hash := repoConfig.Hash()
+func processJob(job *Job) {
+	log.WithField("repo", job.Config.URL).WithField("attempt", job.Attempts).Info("Received task")
+	rc := job.Config
 
-		if _, exists := readyRepos[hash]; exists {
-			continue
+	// a refresh keeps the old result until the new one is ready
+	if job.Refresh && job.Result != nil && job.Result.Stat != nil {
+		head, err := RemoteHead(rc.URL)
+		if err == nil && head == job.Result.Stat.Commit && rc.Ref == "" && rc.AsOf == "" {
+			if err = jobs.Finish(job.Hash, workerID, job.Result); err != nil {
+				log.WithError(err).WithField("job", job.Hash).Error("Can't save job result")
+			}
+			return
 		}
-		repo := repoConfig.Repo()
+		rc.ExpireMirror()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if jobTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, jobTimeout)
+		defer cancelTimeout()
+	}
 
-		repo.Stat, err = repoConfig.Stat()
+	report := &jobReporter{hash: job.Hash}
+	running.start(job, cancel)
+	defer running.finish(job.Hash)
+	done := make(chan bool)
+	go report.keepLease(done)
+	defer close(done)
 
+	repo := rc.Repo()
+	var err error
+	repo.Stat, err = rc.Stat(ctx, report)
+
+	if err != nil {
+		err = jobContextError(ctx, err)
+		log.WithError(err).WithField("repo", rc.URL).WithField("attempt", job.Attempts).Error("Can't fetch repostat")
+		if isTemporary(err) && job.Attempts < JOB_MAX_ATTEMPTS {
+			err = jobs.Retry(job.Hash, workerID, err, time.Now().Add(retryDelay(job.Attempts)))
+		} else if job.Refresh && job.Result != nil {
+			err = jobs.Finish(job.Hash, workerID, job.Result)
+		} else {
+			err = jobs.Fail(job.Hash, workerID, err)
+		}
 		if err != nil {
-			log.WithError(err).Error("Can't fetch repostat")
-			continue
+			log.WithError(err).WithField("job", job.Hash).Error("Can't save job state")
 		}
+		return
+	}
 
-		readyRepos[hash] = repo
+	if err = jobs.Finish(job.Hash, workerID, repo); err != nil {
+		log.WithError(err).WithField("job", job.Hash).Error("Can't save job result")
 	}
 }
 
-func workerHandler() {
+func workerLoop() {
+	for {
+		job, err := jobs.Claim(workerID, workerNode)
+		if err != nil {
+			log.WithError(err).Error("Can't claim job")
+		}
+		if job != nil {
+			processJob(job)
+			continue
+		}
+		select {
+		case <-jobsWakeup:
+		case <-time.After(JOB_POLL_INTERVAL):
+		}
+	}
+}
+
+func workerHandler(listen string) {
+	if mongoSession != nil {
+		jobs = mongoJobStore{}
+	} else {
+		log.Warn("Running without MongoDB, queued jobs are lost on restart")
+		jobs = newMemoryJobStore()
+	}
 
 	go workerLoop()
 	r := gin.Default()
@@ -608,9 +748,15 @@ func workerHandler() {
 		if len(tokens) > 0 {
 			res := gin.H{}
 
-			for _, token := range tokens {
-				if v, exists := readyRepos[token]; exists {
-					res[token] = v
+			found, err := jobs.Get(tokens)
+			if err != nil {
+				log.WithError(err).Error("Can't read jobs")
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			for _, job := range found {
+				if job.State == JobDone && job.Result != nil {
+					res[job.Hash] = job.Result
 				}
 			}
 			if len(res) > 0 {
@@ -624,22 +770,91 @@ func workerHandler() {
 		return
 	})
 
+	r.GET("/progress/:hash", func(c *gin.Context) {
+		hash := c.Param("hash")
+		if p, exists := running.Get(hash); exists {
+			c.JSON(200, p)
+			return
+		}
+
+		found, err := jobs.Get([]string{hash})
+		if err != nil {
+			log.WithError(err).Error("Can't read jobs")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if len(found) == 0 {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.JSON(200, JobProgress{Hash: hash, State: found[0].State, Attempts: found[0].Attempts, Error: found[0].Error})
+	})
+
+	r.POST("/cancel/:hash", func(c *gin.Context) {
+		hash := c.Param("hash")
+		if running.cancel(hash) {
+			c.String(200, "canceled")
+			return
+		}
+
+		canceled, err := jobs.Cancel(hash, errJobCanceled)
+		if err != nil {
+			log.WithError(err).Error("Can't cancel job")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if !canceled {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.String(200, "canceled")
+	})
+
+	r.POST("/failed", func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+
+		found, err := jobs.Get(strings.Split(string(body), ","))
+		if err != nil {
+			log.WithError(err).Error("Can't read jobs")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		res := gin.H{}
+		for _, job := range found {
+			if job.State == JobFailed {
+				res[job.Hash] = job.Error
+			}
+		}
+		if len(res) == 0 {
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.JSON(200, res)
+	})
+
 	r.POST("/query", func(c *gin.Context) {
 		body, _ := ioutil.ReadAll(c.Request.Body)
 
 		repoURL := string(body)
 		fmt.Println("repo: " + repoURL)
-		r := RepoConfig{URL: repoURL}
+		r := RepoConfig{URL: repoURL, Ref: c.Query("ref"), AsOf: c.Query("asof")}
+		if _, _, _, err := r.ParseURL(); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
 
-		hash := r.Hash()
-		if _, exists := readyRepos[hash]; !exists {
-			tasks <- repoURL
+		job, err := jobs.Enqueue(r, c.Query("refresh") != "", workerNode)
+		if err != nil {
+			log.WithError(err).Error("Can't queue job")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
 		}
-		c.String(200, hash)
+		wakeupWorker()
+		c.String(200, job.Hash)
 		return
 	})
 
-	r.Run(":7777")
+	r.Run(listen)
 	/*
 		repoStat, err := jobs.RegisterType("repoStat", 3, func(repoURL string) error {
 			msg := fmt.Sprintf("Hello, %s! Thanks for signing up for foo.com.", user.Name)
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitTestRepo makes a repo at dir with a commit of the files by the author
+func gitTestRepo(t *testing.T, dir, email string, files map[string]string) string {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=" + email}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	git("add", "-A")
+	git("commit", "-q", "-m", "initial")
+	return git("rev-parse", "HEAD")
+}
+
+func TestStatResolvesSubgroupAuthors(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gitfluence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer func(dir string) { reposDir = dir }(reposDir)
+	reposDir = tmp
+
+	rc := RepoConfig{URL: "https://gitlab.subgroups.test/group/sub/repo"}
+	repoPath, err := rc.mirrorPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha := gitTestRepo(t, repoPath, "alice@example.com", map[string]string{"main.go": "package main\n\nfunc main() {}\n"})
+	touchMirrorFile(repoPath, MIRROR_FETCHED_FILE)
+
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.URL.EscapedPath())
+		switch req.URL.EscapedPath() {
+		case "/api/v4/projects/group%2Fsub%2Frepo/repository/commits/" + sha:
+			json.NewEncoder(w).Encode(map[string]string{"author_email": "alice@example.com"})
+		case "/api/v4/users":
+			json.NewEncoder(w).Encode([]map[string]string{{"username": "alice"}})
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+	RegisterResolver("gitlab.subgroups.test", &GitlabResolver{BaseURL: server.URL})
+
+	rs, err := rc.Stat(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.Users) != 1 || rs.Users[0].Username != "alice" {
+		t.Errorf("got users %+v, want alice resolved, API paths %v", rs.Users, paths)
+	}
+}
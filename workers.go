@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// self-registered workers are dropped when they miss heartbeats for that long
+const WORKER_HEARTBEAT_TTL = 30 * time.Second
+const WORKER_HEARTBEAT_INTERVAL = 10 * time.Second
+const WORKER_PING_INTERVAL = 5 * time.Second
+
+// virtual nodes per worker on the hash ring, more nodes spread repos more evenly
+const WORKER_RING_REPLICAS = 64
+
+var errNoWorkers = errors.New("No workers available")
+
+var workerPingClient = &http.Client{Timeout: 2 * time.Second}
+
+type workerInfo struct {
+	url      string
+	static   bool
+	alive    bool
+	lastSeen time.Time
+}
+
+type ringNode struct {
+	point uint32
+	url   string
+}
+
+type ByPoint []ringNode
+
+func (a ByPoint) Len() int           { return len(a) }
+func (a ByPoint) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByPoint) Less(i, j int) bool { return a[i].point < a[j].point }
+
+// WorkerRegistry keeps the known workers on a consistent hash ring, so a repo always goes to the
+// worker holding its mirror. Dead workers are skipped and their repos go to the next worker on the ring
+type WorkerRegistry struct {
+	mu      sync.RWMutex
+	workers map[string]*workerInfo
+	ring    []ringNode
+}
+
+var workers = &WorkerRegistry{workers: make(map[string]*workerInfo)}
+
+// normalizeWorkerURL turns "host:port" or "http://host:port" into "http://host:port/"
+func normalizeWorkerURL(u string) string {
+	u = strings.TrimSpace(u)
+	if u == "" {
+		return ""
+	}
+	if !strings.Contains(u, "://") {
+		u = "http://" + u
+	}
+	return strings.TrimSuffix(u, "/") + "/"
+}
+
+// AddStatic adds workers which are never dropped from the ring, only marked dead while /ping fails
+func (r *WorkerRegistry) AddStatic(urls []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range urls {
+		if u = normalizeWorkerURL(u); u != "" {
+			r.workers[u] = &workerInfo{url: u, static: true, alive: true, lastSeen: time.Now()}
+		}
+	}
+	r.rebuild()
+}
+
+// Register adds a worker or records its heartbeat
+func (r *WorkerRegistry) Register(u string) {
+	u = normalizeWorkerURL(u)
+	if u == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, exists := r.workers[u]
+	if !exists {
+		log.WithField("worker", u).Info("Worker registered")
+		w = &workerInfo{url: u}
+		r.workers[u] = w
+		r.rebuild()
+	}
+	w.alive = true
+	w.lastSeen = time.Now()
+}
+
+// MarkDown takes the worker out of dispatch until its next successful ping
+func (r *WorkerRegistry) MarkDown(u string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if w, exists := r.workers[u]; exists && w.alive {
+		log.WithField("worker", u).Warn("Worker is down")
+		w.alive = false
+	}
+}
+
+func (r *WorkerRegistry) rebuild() {
+	r.ring = r.ring[:0]
+	for u := range r.workers {
+		for i := 0; i < WORKER_RING_REPLICAS; i++ {
+			r.ring = append(r.ring, ringNode{point: crc32.ChecksumIEEE([]byte(u + "#" + strconv.Itoa(i))), url: u})
+		}
+	}
+	sort.Sort(ByPoint(r.ring))
+}
+
+// WorkerFor returns the first alive worker on the ring after the repo hash
+func (r *WorkerRegistry) WorkerFor(hash string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.ring) == 0 {
+		return "", errNoWorkers
+	}
+
+	point := crc32.ChecksumIEEE([]byte(hash))
+	start := sort.Search(len(r.ring), func(i int) bool { return r.ring[i].point >= point })
+	for i := 0; i < len(r.ring); i++ {
+		node := r.ring[(start+i)%len(r.ring)]
+		if r.workers[node.url].alive {
+			return node.url, nil
+		}
+	}
+	return "", errNoWorkers
+}
+
+func (r *WorkerRegistry) urls() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var res []string
+	for u := range r.workers {
+		res = append(res, u)
+	}
+	return res
+}
+
+func pingWorker(u string) bool {
+	resp, err := workerPingClient.Get(u + "ping")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// check pings all workers and drops self-registered ones without recent heartbeats
+func (r *WorkerRegistry) check() {
+	for _, u := range r.urls() {
+		alive := pingWorker(u)
+
+		r.mu.Lock()
+		w, exists := r.workers[u]
+		if !exists {
+			r.mu.Unlock()
+			continue
+		}
+		if alive != w.alive {
+			log.WithField("worker", u).WithField("alive", alive).Info("Worker state changed")
+		}
+		w.alive = alive
+		if alive {
+			w.lastSeen = time.Now()
+		} else if !w.static && time.Since(w.lastSeen) > WORKER_HEARTBEAT_TTL {
+			log.WithField("worker", u).Info("Worker unregistered")
+			delete(r.workers, u)
+			r.rebuild()
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *WorkerRegistry) healthLoop() {
+	for {
+		r.check()
+		time.Sleep(WORKER_PING_INTERVAL)
+	}
+}
+
+// workers send it in WORKER_SECRET_HEADER to /register, registration is disabled while it's empty
+var registerSecret string
+
+const WORKER_SECRET_HEADER = "X-Gitfluence-Secret"
+
+// registerHandler adds the worker posted in the body to the ring if the request carries the shared secret
+func registerHandler(c *gin.Context) {
+	secret := c.Request.Header.Get(WORKER_SECRET_HEADER)
+	if registerSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(registerSecret)) != 1 {
+		log.WithField("ip", c.ClientIP()).Warn("Worker registration refused")
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	body, _ := ioutil.ReadAll(c.Request.Body)
+	workers.Register(string(body))
+	c.String(200, "ok")
+}
+
+// heartbeatLoop registers the worker at the frontend server until the process exits
+func heartbeatLoop(serverURL, advertiseURL string) {
+	serverURL = normalizeWorkerURL(serverURL)
+	for {
+		req, err := http.NewRequest("POST", serverURL+"register", strings.NewReader(advertiseURL))
+		if err != nil {
+			log.WithError(err).WithField("server", serverURL).Fatal("Bad -register")
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set(WORKER_SECRET_HEADER, registerSecret)
+		resp, err := workerPingClient.Do(req)
+		if err != nil {
+			log.WithError(err).WithField("server", serverURL).Error("Can't register worker")
+		} else {
+			if resp.StatusCode != http.StatusOK {
+				log.WithField("server", serverURL).WithField("status", resp.Status).Error("Worker registration refused")
+			}
+			resp.Body.Close()
+		}
+		time.Sleep(WORKER_HEARTBEAT_INTERVAL)
+	}
+}
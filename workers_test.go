@@ -0,0 +1,213 @@
+package main
+
+import (
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestRegistry() *WorkerRegistry {
+	return &WorkerRegistry{workers: make(map[string]*workerInfo)}
+}
+
+// pingServer is a worker answering /ping
+func pingServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/ping" {
+			http.NotFound(w, req)
+		}
+	}))
+}
+
+func TestWorkerForIsStable(t *testing.T) {
+	a, b := newTestRegistry(), newTestRegistry()
+	a.AddStatic([]string{"w1:8080", "w2:8080", "w3:8080"})
+	b.Register("http://w3:8080/")
+	b.Register("w1:8080")
+	b.Register("http://w2:8080")
+
+	used := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		hash := "repo" + strconv.Itoa(i)
+		wa, err := a.WorkerFor(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wb, _ := b.WorkerFor(hash)
+		if wa != wb {
+			t.Fatalf("%s: %s and %s for the same workers", hash, wa, wb)
+		}
+		if again, _ := a.WorkerFor(hash); again != wa {
+			t.Fatalf("%s: %s, then %s", hash, wa, again)
+		}
+		used[wa] = true
+	}
+	if len(used) != 3 {
+		t.Errorf("repos went to %d workers of 3", len(used))
+	}
+
+	// a new worker takes over about a quarter of the repos, the rest stay where their mirrors are
+	b.Register("w4:8080")
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		hash := "repo" + strconv.Itoa(i)
+		wa, _ := a.WorkerFor(hash)
+		wb, _ := b.WorkerFor(hash)
+		if wa != wb {
+			if wb != "http://w4:8080/" {
+				t.Fatalf("%s moved from %s to %s, not to the new worker", hash, wa, wb)
+			}
+			moved++
+		}
+	}
+	if moved < 150 || moved > 350 {
+		t.Errorf("%d of 1000 repos moved to the new worker", moved)
+	}
+}
+
+func TestWorkerForFailover(t *testing.T) {
+	r := newTestRegistry()
+	r.AddStatic([]string{"w1:8080", "w2:8080", "w3:8080"})
+
+	before := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		hash := "repo" + strconv.Itoa(i)
+		before[hash], _ = r.WorkerFor(hash)
+	}
+
+	down := before["repo0"]
+	r.MarkDown(down)
+	for hash, w := range before {
+		got, err := r.WorkerFor(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != down && got != w {
+			t.Errorf("%s moved from %s to %s although %s is up", hash, w, got, w)
+		}
+		if w == down && got == down {
+			t.Errorf("%s still goes to %s which is down", hash, down)
+		}
+		if w == down && got != nextAliveOnRing(r, hash) {
+			t.Errorf("%s went to %s, not to the next worker on the ring", hash, got)
+		}
+	}
+
+	for _, u := range r.urls() {
+		r.MarkDown(u)
+	}
+	if _, err := r.WorkerFor("repo0"); err != errNoWorkers {
+		t.Errorf("got %v with all workers down, want %v", err, errNoWorkers)
+	}
+}
+
+// nextAliveOnRing walks the ring from the repo hash without the registry's search
+func nextAliveOnRing(r *WorkerRegistry, hash string) string {
+	point := crc32.ChecksumIEEE([]byte(hash))
+	best, first := "", ""
+	var bestPoint, firstPoint uint32
+	for _, node := range r.ring {
+		if !r.workers[node.url].alive {
+			continue
+		}
+		if first == "" || node.point < firstPoint {
+			first, firstPoint = node.url, node.point
+		}
+		if node.point >= point && (best == "" || node.point < bestPoint) {
+			best, bestPoint = node.url, node.point
+		}
+	}
+	if best == "" {
+		return first
+	}
+	return best
+}
+
+func TestWorkerRegistryCheck(t *testing.T) {
+	up, gone, static := pingServer(), pingServer(), pingServer()
+	defer up.Close()
+	defer static.Close()
+
+	r := newTestRegistry()
+	r.AddStatic([]string{static.URL})
+	r.Register(up.URL)
+	r.Register(gone.URL)
+	gone.Close()
+	static.Close()
+
+	// a missed heartbeat within the TTL only marks the worker dead
+	r.check()
+	if len(r.urls()) != 3 {
+		t.Fatalf("got workers %v, want all 3 until the TTL passes", r.urls())
+	}
+	if r.workers[normalizeWorkerURL(gone.URL)].alive {
+		t.Errorf("%s is alive after a failed ping", gone.URL)
+	}
+
+	// the heartbeat is late, the self-registered worker is dropped and the static one is kept
+	for _, w := range r.workers {
+		w.lastSeen = time.Now().Add(-WORKER_HEARTBEAT_TTL - time.Second)
+	}
+	r.check()
+	if _, exists := r.workers[normalizeWorkerURL(gone.URL)]; exists {
+		t.Errorf("%s is kept after missing heartbeats", gone.URL)
+	}
+	if w, exists := r.workers[normalizeWorkerURL(static.URL)]; !exists || w.alive {
+		t.Errorf("static worker %s must stay on the ring marked dead", static.URL)
+	}
+	for i := 0; i < 100; i++ {
+		if w, _ := r.WorkerFor("repo" + strconv.Itoa(i)); w != normalizeWorkerURL(up.URL) {
+			t.Fatalf("got %s, want the only alive worker %s", w, up.URL)
+		}
+	}
+
+	// a worker marked down after a failed request is back with its next ping
+	r.MarkDown(normalizeWorkerURL(up.URL))
+	r.check()
+	if !r.workers[normalizeWorkerURL(up.URL)].alive {
+		t.Errorf("%s answers /ping but is still down", up.URL)
+	}
+}
+
+func TestRegisterHandler(t *testing.T) {
+	defer func(secret string, registry *WorkerRegistry) { registerSecret, workers = secret, registry }(registerSecret, workers)
+	workers = newTestRegistry()
+	r := gin.New()
+	r.POST("/register", registerHandler)
+
+	register := func(secret string) int {
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader("w1:8080"))
+		if secret != "" {
+			req.Header.Set(WORKER_SECRET_HEADER, secret)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	registerSecret = ""
+	if code := register("s3cret"); code != http.StatusForbidden {
+		t.Errorf("got %d without a configured secret, want 403", code)
+	}
+	registerSecret = "s3cret"
+	for _, secret := range []string{"", "wrong", "s3cret2"} {
+		if code := register(secret); code != http.StatusForbidden {
+			t.Errorf("secret %q: got %d, want 403", secret, code)
+		}
+	}
+	if len(workers.urls()) != 0 {
+		t.Fatalf("refused requests registered %v", workers.urls())
+	}
+	if code := register("s3cret"); code != http.StatusOK {
+		t.Errorf("got %d with the secret, want 200", code)
+	}
+	if urls := workers.urls(); len(urls) != 1 || urls[0] != "http://w1:8080/" {
+		t.Errorf("got workers %v, want http://w1:8080/", urls)
+	}
+}